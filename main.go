@@ -88,6 +88,23 @@ func main() {
 						Value:   "info",
 						Usage:   "log level (debug, info, warn, error)",
 					},
+					&cli.StringFlag{
+						Name:    "protocol",
+						Aliases: []string{"P"},
+						Value:   "auto",
+						EnvVars: []string{"SSH_DATA_PROTOCOL"},
+						Usage:   "protocol to speak (auto, json, text); auto detects it from the first line",
+					},
+					&cli.IntFlag{
+						Name:  "sub-buffer",
+						Value: 1024,
+						Usage: "default number of messages queued per subscription",
+					},
+					&cli.StringFlag{
+						Name:  "slow-consumer",
+						Value: "drop-oldest",
+						Usage: "default policy for subscriptions with a full queue (drop-oldest, drop-newest, disconnect)",
+					},
 				},
 				Usage: "start the ssh-data user server (this communicates over stdin/stdout to be called on a normal ssh server)",
 				Action: func(c *cli.Context) error {
@@ -109,7 +126,19 @@ func main() {
 					logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 						Level: logLevel,
 					}))
-					err = startUserServer(logger, c.String("db-path"))
+					protocol, err := server.ParseProtocol(c.String("protocol"))
+					if err != nil {
+						return err
+					}
+					policy, err := server.ParseSlowConsumerPolicy(c.String("slow-consumer"))
+					if err != nil {
+						return err
+					}
+					err = startUserServer(logger, c.String("db-path"), server.UserServerOptions{
+						Protocol:           protocol,
+						SubscriptionBuffer: c.Int("sub-buffer"),
+						SlowConsumerPolicy: policy,
+					})
 					if err != nil {
 						logger.Error("Error starting user server", "error", err)
 					}
@@ -192,7 +221,8 @@ func main() {
 					if err != nil {
 						return fmt.Errorf("could not read authorized_keys file: %w", err)
 					}
-					ssh.ParseAuthorizedKey(authBytes)
+					_, _, _, _, err = ssh.ParseAuthorizedKey(authBytes)
+					return err
 				},
 			},
 		},
@@ -213,10 +243,10 @@ func main() {
 //	return srv.Start(os.Stdin, os.Stdout)
 //}
 
-func startUserServer(logger *slog.Logger, dbPath string) error {
+func startUserServer(logger *slog.Logger, dbPath string, options server.UserServerOptions) error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT)
 	defer stop()
-	srv, err := server.NewUserServer(logger, ctx, dbPath)
+	srv, err := server.NewUserServer(logger, ctx, dbPath, options)
 	if err != nil {
 		return err
 	}
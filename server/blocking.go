@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Blocking commands retry a data command whenever data was written until it
+// has a result or their timeout expires. Writes of this process signal a
+// change once they are committed, writes of other processes once the relay
+// notices them, so waiting does not depend on polling the database.
+
+// changes returns a channel that is closed on the next write.
+func (db *UserDB) changes() <-chan struct{} {
+	db.changedMux.Lock()
+	defer db.changedMux.Unlock()
+	return db.changed
+}
+
+// signalChange wakes up everyone waiting for a write.
+func (db *UserDB) signalChange() {
+	db.changedMux.Lock()
+	defer db.changedMux.Unlock()
+	close(db.changed)
+	db.changed = make(chan struct{})
+}
+
+// parseDuration parses a non-negative duration given either as number of
+// seconds (e.g. "1.5", like the timeouts of BLPOP) or as Go duration (e.g.
+// "1m30s"), so all commands taking timeouts accept both forms.
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds < 0 || math.IsNaN(seconds) || seconds > float64(math.MaxInt64)/float64(time.Second) {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return d, nil
+}
+
+// argTimeout returns the i-th argument as timeout (see parseDuration), 0
+// meaning forever.
+func argTimeout(args []any, i int) (time.Duration, error) {
+	s, err := argString(args, i)
+	if err != nil {
+		return 0, err
+	}
+	return parseDuration(s)
+}
+
+// block runs fn in a transaction until it returns a non-nil result and
+// returns that, or nil once timeout (0 meaning forever) expired.
+func (s *session) block(timeout time.Duration, fn dataCommandFunc, args []any) (any, error) {
+	return s.blockUntil(timeout, func(t *txn) (any, int64, error) {
+		result, err := fn(t, args)
+		return result, 0, err
+	})
+}
+
+// blockUntil is like block for commands whose results may also become
+// available without a write once some time has passed (e.g. when a lease
+// expires). Besides its result, fn returns the time in unix milliseconds at
+// which it should be retried even if nothing was written, 0 if there is none.
+func (s *session) blockUntil(timeout time.Duration, fn func(t *txn) (any, int64, error)) (any, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		changed := s.userDB.changes()
+		var result any
+		var retry int64
+		err := s.userDB.update(s.ctx, func(t *txn) (err error) {
+			result, retry, err = fn(t)
+			return err
+		})
+		if err != nil || result != nil {
+			return result, err
+		}
+		var retryAt <-chan time.Time
+		var retryTimer *time.Timer
+		if retry != 0 {
+			retryTimer = time.NewTimer(time.Until(time.UnixMilli(retry)))
+			retryAt = retryTimer.C
+		}
+		timedOut := false
+		select {
+		case <-changed:
+		case <-retryAt:
+		case <-expired:
+			timedOut = true
+		case <-s.ctx.Done():
+			err = s.ctx.Err()
+		}
+		if retryTimer != nil {
+			retryTimer.Stop()
+		}
+		if timedOut || err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/tionis/ssh-data/util"
+	"strings"
+	"sync"
+)
+
+// SlowConsumerPolicy decides what happens to a message published to a
+// subscriber whose queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest SlowConsumerPolicy = iota
+	// DropNewest discards the published message.
+	DropNewest
+	// Disconnect discards the published message and closes the subscriber.
+	Disconnect
+)
+
+// ParseSlowConsumerPolicy parses the name of a policy as used on the command
+// line and in the protocol.
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	switch strings.ToLower(s) {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "drop-newest":
+		return DropNewest, nil
+	case "disconnect":
+		return Disconnect, nil
+	default:
+		return DropOldest, fmt.Errorf("invalid slow consumer policy: %s", s)
+	}
+}
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "drop-oldest"
+	}
+}
+
+// broker fans out published messages to every subscriber of a channel and
+// to every pattern subscriber whose pattern list matches the channel.
+// Publishing never blocks: every subscriber has its own bounded queue and
+// its policy decides what happens when that queue is full.
+type broker struct {
+	mux       sync.Mutex
+	subs      map[string]map[*subscriber]struct{}
+	psubs     map[*subscriber]struct{}
+	published int64
+	dropped   int64
+}
+
+func newBroker() *broker {
+	return &broker{
+		subs:  make(map[string]map[*subscriber]struct{}),
+		psubs: make(map[*subscriber]struct{}),
+	}
+}
+
+// subscriber is the receiving end of a subscription to a channel or, if
+// patterns is set, to all channels matching a pattern list.
+type subscriber struct {
+	channel  string
+	pattern  string
+	patterns []*util.Pattern
+	size     int
+	policy   SlowConsumerPolicy
+	mux      sync.Mutex
+	queue    []channelMessage
+	dropped  int64
+	closed   bool
+	// ready is signalled whenever a message was queued or the subscriber was
+	// closed.
+	ready chan struct{}
+}
+
+func newSubscriber(size int, policy SlowConsumerPolicy) *subscriber {
+	if size < 1 {
+		size = 1
+	}
+	return &subscriber{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// subscribe registers a new subscriber for channel with a queue of the given
+// size.
+func (b *broker) subscribe(channel string, size int, policy SlowConsumerPolicy) *subscriber {
+	sub := newSubscriber(size, policy)
+	sub.channel = channel
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	subs, ok := b.subs[channel]
+	if !ok {
+		subs = make(map[*subscriber]struct{})
+		b.subs[channel] = subs
+	}
+	subs[sub] = struct{}{}
+	return sub
+}
+
+// psubscribe registers a new subscriber for all channels matching the
+// comma-separated pattern list with a queue of the given size.
+func (b *broker) psubscribe(pattern string, size int, policy SlowConsumerPolicy) (*subscriber, error) {
+	patterns, err := util.ParsePatternList(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sub := newSubscriber(size, policy)
+	sub.pattern = pattern
+	sub.patterns = patterns
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.psubs[sub] = struct{}{}
+	return sub, nil
+}
+
+// unsubscribe removes sub from the broker and closes it.
+func (b *broker) unsubscribe(sub *subscriber) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.remove(sub)
+	sub.close()
+}
+
+// remove removes sub from the broker, b.mux must be held.
+func (b *broker) remove(sub *subscriber) {
+	if sub.patterns != nil {
+		delete(b.psubs, sub)
+		return
+	}
+	subs := b.subs[sub.channel]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subs, sub.channel)
+	}
+}
+
+// publish queues message for every subscriber of channel and returns the
+// number of subscribers that received it.
+func (b *broker) publish(channel, message string) int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.published++
+	received := 0
+	for sub := range b.subs[channel] {
+		if b.offer(sub, channelMessage{Channel: channel, Message: message}) {
+			received++
+		}
+	}
+	for sub := range b.psubs {
+		if !util.MatchPatternList(sub.patterns, channel) {
+			continue
+		}
+		if b.offer(sub, channelMessage{Pattern: sub.pattern, Channel: channel, Message: message}) {
+			received++
+		}
+	}
+	return received
+}
+
+// offer queues msg for sub, updates the counters and applies the Disconnect
+// policy. It reports whether msg was queued, b.mux must be held.
+func (b *broker) offer(sub *subscriber, msg channelMessage) bool {
+	ok, dropped := sub.offer(msg)
+	if dropped {
+		b.dropped++
+	}
+	if !ok && sub.policy == Disconnect {
+		b.remove(sub)
+		sub.close()
+	}
+	return ok
+}
+
+// stats returns the number of channels, channel subscribers and pattern
+// subscribers together with the number of published and dropped messages.
+func (b *broker) stats() (channels, subscribers, psubscribers int, published, dropped int64) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for _, subs := range b.subs {
+		subscribers += len(subs)
+	}
+	return len(b.subs), subscribers, len(b.psubs), b.published, b.dropped
+}
+
+// numSub returns the number of subscribers of channel.
+func (b *broker) numSub(channel string) int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return len(b.subs[channel])
+}
+
+// channels returns the names of all channels with at least one subscriber.
+func (b *broker) channels() []string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	channels := make([]string, 0, len(b.subs))
+	for channel := range b.subs {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// offer queues msg according to the policy of the subscriber. It reports
+// whether msg was queued and whether a message was dropped.
+func (sub *subscriber) offer(msg channelMessage) (ok, dropped bool) {
+	sub.mux.Lock()
+	defer sub.mux.Unlock()
+	if sub.closed {
+		return false, false
+	}
+	if len(sub.queue) >= sub.size {
+		sub.dropped++
+		if sub.policy != DropOldest {
+			return false, true
+		}
+		sub.queue = sub.queue[1:]
+		dropped = true
+	}
+	sub.queue = append(sub.queue, msg)
+	sub.signal()
+	return true, dropped
+}
+
+// next returns the next queued message, waiting for one if necessary. It
+// returns false once the subscriber is closed or ctx is done.
+func (sub *subscriber) next(ctx context.Context) (channelMessage, bool) {
+	for {
+		sub.mux.Lock()
+		if sub.closed {
+			sub.mux.Unlock()
+			return channelMessage{}, false
+		}
+		if len(sub.queue) > 0 {
+			msg := sub.queue[0]
+			sub.queue = sub.queue[1:]
+			sub.mux.Unlock()
+			return msg, true
+		}
+		sub.mux.Unlock()
+		select {
+		case <-ctx.Done():
+			return channelMessage{}, false
+		case <-sub.ready:
+		}
+	}
+}
+
+// status returns the number of queued and dropped messages and whether the
+// subscriber is closed.
+func (sub *subscriber) status() (queued int, dropped int64, closed bool) {
+	sub.mux.Lock()
+	defer sub.mux.Unlock()
+	return len(sub.queue), sub.dropped, sub.closed
+}
+
+func (sub *subscriber) close() {
+	sub.mux.Lock()
+	defer sub.mux.Unlock()
+	sub.closed = true
+	sub.queue = nil
+	sub.signal()
+}
+
+// signal wakes up a waiting next call, sub.mux must be held.
+func (sub *subscriber) signal() {
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
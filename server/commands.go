@@ -0,0 +1,271 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// commandFunc executes a command with the given arguments (without the command
+// name itself) and returns the result to send to the client.
+type commandFunc func(s *session, args []any) (any, error)
+
+// commands maps lower-case command names to their implementation.
+var commands map[string]commandFunc
+
+// dataCommands maps lower-case command names to the implementation of
+// commands that only work on the stored data. Each of them runs in its own
+// transaction.
+var dataCommands map[string]dataCommandFunc
+
+func init() {
+	commands = map[string]commandFunc{
+		"sql":        cmdSQL,
+		"pub":        cmdPub,
+		"sub":        cmdSub,
+		"unsub":      cmdUnsub,
+		"psub":       cmdPSub,
+		"punsub":     cmdPUnsub,
+		"pubsub":     cmdPubSub,
+		"multi":      cmdMulti,
+		"exec":       cmdExec,
+		"discard":    cmdDiscard,
+		"watch":      cmdWatch,
+		"unwatch":    cmdUnwatch,
+		"blpop":      blockingPopCommand(true),
+		"brpop":      blockingPopCommand(false),
+		"blmove":     cmdBLMove,
+		"brpoplpush": cmdBRPopLPush,
+		"streams":    cmdStreams,
+		"end":        cmdEnd,
+	}
+	dataCommands = map[string]dataCommandFunc{
+		"del":            cmdDel,
+		"exists":         cmdExists,
+		"type":           cmdType,
+		"rename":         cmdRename,
+		"config":         cmdConfig,
+		"scan":           cmdScan,
+		"ls":             cmdLs,
+		"expire":         expireCommand("EX"),
+		"pexpire":        expireCommand("PX"),
+		"expireat":       expireCommand("EXAT"),
+		"pexpireat":      expireCommand("PXAT"),
+		"ttl":            ttlCommand(time.Second),
+		"pttl":           ttlCommand(time.Millisecond),
+		"persist":        cmdPersist,
+		"version":        cmdVersion,
+		"lock":           cmdLock,
+		"renew":          cmdRenew,
+		"unlock":         cmdUnlock,
+		"fence":          cmdFence,
+		"get":            cmdGet,
+		"set":            cmdSet,
+		"mget":           cmdMGet,
+		"mset":           cmdMSet,
+		"cas":            cmdCAS,
+		"incr":           incrCommand(1, false),
+		"decr":           incrCommand(-1, false),
+		"incrby":         incrCommand(1, true),
+		"decrby":         incrCommand(-1, true),
+		"incrbyfloat":    cmdIncrByFloat,
+		"append":         cmdAppend,
+		"strlen":         cmdStrLen,
+		"getrange":       cmdGetRange,
+		"setrange":       cmdSetRange,
+		"getset":         cmdGetSet,
+		"getdel":         cmdGetDel,
+		"json.set":       cmdJSONSet,
+		"json.get":       cmdJSONGet,
+		"json.del":       cmdJSONDel,
+		"json.type":      cmdJSONType,
+		"json.arrappend": cmdJSONArrAppend,
+		"json.arrpop":    cmdJSONArrPop,
+		"json.numincrby": cmdJSONNumIncrBy,
+		"json.objkeys":   cmdJSONObjKeys,
+		"json.merge":     cmdJSONMerge,
+		"json.patch":     cmdJSONPatch,
+		"json.schema":    cmdJSONSchema,
+		"json.find":      cmdJSONFind,
+		"json.index":     cmdJSONIndex,
+		"hset":           cmdHSet,
+		"hsetnx":         cmdHSetNX,
+		"hget":           cmdHGet,
+		"hmget":          cmdHMGet,
+		"hgetall":        cmdHGetAll,
+		"hkeys":          hashListCommand(0),
+		"hvals":          hashListCommand(1),
+		"hdel":           cmdHDel,
+		"hlen":           cmdHLen,
+		"hexists":        cmdHExists,
+		"hincrby":        cmdHIncrBy,
+		"hincrbyfloat":   cmdHIncrByFloat,
+		"hscan":          cmdHScan,
+		"lpush":          pushCommand(true),
+		"rpush":          pushCommand(false),
+		"lpop":           popCommand(true),
+		"rpop":           popCommand(false),
+		"llen":           cmdLLen,
+		"lrange":         cmdLRange,
+		"ltrim":          cmdLTrim,
+		"lindex":         cmdLIndex,
+		"lset":           cmdLSet,
+		"lmove":          cmdLMove,
+		"rpoplpush":      cmdRPopLPush,
+		"sadd":           cmdSAdd,
+		"srem":           cmdSRem,
+		"smembers":       cmdSMembers,
+		"sismember":      cmdSIsMember,
+		"scard":          cmdSCard,
+		"sinter":         setOperationCommand("inter", false),
+		"sunion":         setOperationCommand("union", false),
+		"sdiff":          setOperationCommand("diff", false),
+		"sinterstore":    setOperationCommand("inter", true),
+		"sunionstore":    setOperationCommand("union", true),
+		"sdiffstore":     setOperationCommand("diff", true),
+		"zadd":           cmdZAdd,
+		"zincrby":        cmdZIncrBy,
+		"zrem":           cmdZRem,
+		"zscore":         cmdZScore,
+		"zcard":          cmdZCard,
+		"zrank":          rankCommand(false),
+		"zrevrank":       rankCommand(true),
+		"zrange":         cmdZRange,
+		"zrangebyscore":  cmdZRangeByScore,
+		"zcount":         cmdZCount,
+		"zpopmin":        zpopCommand(false),
+		"zpopmax":        zpopCommand(true),
+	}
+}
+
+var errWrongNumberOfArguments = errors.New("invalid number of arguments")
+
+// commandError is an error with a machine-readable code and optional details
+// that are passed on to the client.
+type commandError struct {
+	code    string
+	message string
+	data    any
+}
+
+func (e *commandError) Error() string {
+	return e.code + " " + e.message
+}
+
+// checkArgs returns an error unless the number of arguments is between min and
+// max. A negative max means there is no upper limit.
+func checkArgs(args []any, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return errWrongNumberOfArguments
+	}
+	return nil
+}
+
+// argString returns the i-th argument as a string. Numbers and booleans (as
+// sent in JSON mode) are converted to their textual representation.
+func argString(args []any, i int) (string, error) {
+	switch v := args[i].(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("invalid type of argument %d: expected string", i+1)
+	}
+}
+
+// argInt returns the i-th argument as an integer.
+func argInt(args []any, i int) (int64, error) {
+	s, err := argString(args, i)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid argument %d: expected integer", i+1)
+	}
+	return n, nil
+}
+
+// argStrings returns all arguments starting at the i-th as strings.
+func argStrings(args []any, i int) ([]string, error) {
+	strs := make([]string, 0, len(args)-i)
+	for ; i < len(args); i++ {
+		s, err := argString(args, i)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func cmdSQL(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	query, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return s.userDB.queryRows(query, args[1:]...)
+}
+
+func cmdEnd(*session, []any) (any, error) {
+	return nil, errEndSession
+}
+
+// flagSpec describes a --flag accepted by a command.
+type flagSpec struct {
+	// name is the long name of the flag without dashes.
+	name string
+	// short is an optional single letter alias.
+	short string
+	// hasValue is true if the flag takes a value.
+	hasValue bool
+}
+
+// parseFlags splits the leading flags off args. Flags are only recognized
+// before the first other argument or a "--" argument. The returned map maps
+// the long names of the given flags to their value ("" for flags without a
+// value).
+func parseFlags(args []any, specs ...flagSpec) (map[string]string, []any, error) {
+	flags := make(map[string]string)
+	for len(args) > 0 {
+		arg, ok := args[0].(string)
+		if !ok || len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		var spec *flagSpec
+		for i := range specs {
+			if arg == "--"+specs[i].name || (specs[i].short != "" && arg == "-"+specs[i].short) {
+				spec = &specs[i]
+				break
+			}
+		}
+		if spec == nil {
+			return nil, nil, fmt.Errorf("unknown flag: %s", arg)
+		}
+		if !spec.hasValue {
+			flags[spec.name] = ""
+			continue
+		}
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("missing value for flag %s", arg)
+		}
+		value, err := argString(args, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid value for flag %s: %w", arg, err)
+		}
+		flags[spec.name] = value
+		args = args[1:]
+	}
+	return flags, args, nil
+}
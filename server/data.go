@@ -1 +1,327 @@
 package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Every key in the data table has a type, commands for one type refuse to
+// work on keys holding another one.
+const (
+	typeString = "string"
+	typeJSON   = "json"
+	typeHash   = "hash"
+	typeList   = "list"
+	typeSet    = "set"
+	typeZSet   = "zset"
+)
+
+var (
+	errWrongType = &commandError{code: "WRONGTYPE", message: "operation against a key holding the wrong kind of value"}
+	errNoSuchKey = errors.New("no such key")
+)
+
+// txn is a transaction on the database in which data commands are executed.
+type txn struct {
+	tx  *sql.Tx
+	ctx context.Context
+	db  *UserDB
+	// now is the time of the start of the transaction in unix milliseconds,
+	// keys that expire before it are treated as non-existent.
+	now int64
+	// fence is the fencing token writes are made with, 0 if there is none.
+	fence int64
+	// notifyFlags caches the notify-keyspace-events setting, nil until it is
+	// first needed.
+	notifyFlags *string
+	// schemas caches the registered JSON schemas, nil until they are first
+	// needed.
+	schemas *[]boundSchema
+	// published holds the messages to deliver to local subscribers once the
+	// transaction is committed.
+	published []channelMessage
+	// changed is set if data was written, blocking commands are woken up
+	// once the transaction is committed.
+	changed bool
+}
+
+// dataCommandFunc executes a command that only works on the stored data
+// within a transaction.
+type dataCommandFunc func(t *txn, args []any) (any, error)
+
+// update runs fn in a transaction that is committed if fn succeeds and rolled
+// back otherwise.
+func (db *UserDB) update(ctx context.Context, fn func(t *txn) error) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	t := &txn{tx: tx, ctx: ctx, db: db, now: time.Now().UnixMilli()}
+	err = fn(t)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	for _, msg := range t.published {
+		db.pubsub.publish(msg.Channel, msg.Message)
+	}
+	if t.changed {
+		db.signalChange()
+	}
+	return nil
+}
+
+func (t *txn) exec(query string, args ...any) (sql.Result, error) {
+	return t.tx.ExecContext(t.ctx, query, args...)
+}
+
+func (t *txn) queryRow(query string, args ...any) *sql.Row {
+	return t.tx.QueryRowContext(t.ctx, query, args...)
+}
+
+func (t *txn) query(query string, args ...any) (*sql.Rows, error) {
+	return t.tx.QueryContext(t.ctx, query, args...)
+}
+
+// keyType returns the type of key or "" if it does not exist.
+func (t *txn) keyType(key string) (string, error) {
+	err := t.expire(key)
+	if err != nil {
+		return "", err
+	}
+	var typ string
+	err = t.queryRow("SELECT type FROM data WHERE key = ?;", key).Scan(&typ)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get type of key: %w", err)
+	}
+	return typ, nil
+}
+
+// checkType returns whether key exists and errWrongType if it exists with a
+// type other than typ.
+func (t *txn) checkType(key, typ string) (bool, error) {
+	actual, err := t.keyType(key)
+	if err != nil {
+		return false, err
+	}
+	if actual != "" && actual != typ {
+		return false, errWrongType
+	}
+	return actual != "", nil
+}
+
+// exists returns whether key exists.
+func (t *txn) exists(key string) (bool, error) {
+	typ, err := t.keyType(key)
+	return typ != "", err
+}
+
+// del deletes key and returns whether it existed.
+func (t *txn) del(key string) (bool, error) {
+	err := t.expire(key)
+	if err != nil {
+		return false, err
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return false, err
+	}
+	res, err := t.exec("DELETE FROM data WHERE key = ?;", key)
+	if err != nil {
+		return false, fmt.Errorf("could not delete key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("could not delete key: %w", err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+	return true, t.notify("del", key)
+}
+
+// createKey prepares a write of type typ to key: it returns errWrongType if
+// key holds another type, an error if it is locked or has a schema (see
+// checkNoSchema), and creates key with an empty value if it does not exist.
+// Types that keep their elements in a table of their own reference the key
+// from there.
+func (t *txn) createKey(key, typ string) error {
+	ok, err := t.checkType(key, typ)
+	if err != nil {
+		return err
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return err
+	}
+	err = t.checkNoSchema(key)
+	if err != nil || ok {
+		return err
+	}
+	_, err = t.exec("INSERT INTO data(key, type) VALUES (?, ?);", key, typ)
+	if err != nil {
+		return fmt.Errorf("could not create key: %w", err)
+	}
+	return nil
+}
+
+// modified gives key a new version and publishes a keyspace notification for
+// event.
+func (t *txn) modified(key, event string) error {
+	_, err := t.bumpVersion(key)
+	if err != nil {
+		return err
+	}
+	return t.notify(event, key)
+}
+
+// deleteIfEmpty deletes key if table holds no elements of it, so collections
+// disappear once their last element is removed.
+func (t *txn) deleteIfEmpty(key, table string) error {
+	var empty bool
+	err := t.queryRow("SELECT NOT EXISTS (SELECT 1 FROM "+table+" WHERE key = ?);", key).Scan(&empty)
+	if err != nil {
+		return fmt.Errorf("could not check for elements: %w", err)
+	}
+	if !empty {
+		return nil
+	}
+	_, err = t.del(key)
+	return err
+}
+
+// rename renames key to newKey, replacing newKey if it exists.
+func (t *txn) rename(key, newKey string) error {
+	ok, err := t.exists(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNoSuchKey
+	}
+	if key == newKey {
+		return nil
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return err
+	}
+	_, err = t.del(newKey)
+	if err != nil {
+		return err
+	}
+	_, err = t.exec("UPDATE data SET key = ? WHERE key = ?;", newKey, key)
+	if err != nil {
+		return fmt.Errorf("could not rename key: %w", err)
+	}
+	typ, err := t.keyType(newKey)
+	if err != nil {
+		return err
+	}
+	if typ == typeJSON {
+		err = t.validateJSON(newKey)
+	} else {
+		err = t.checkNoSchema(newKey)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = t.bumpVersion(newKey)
+	if err != nil {
+		return err
+	}
+	err = t.notify("rename_from", key)
+	if err != nil {
+		return err
+	}
+	return t.notify("rename_to", newKey)
+}
+
+func cmdDel(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	keys, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	deleted := 0
+	for _, key := range keys {
+		ok, err := t.del(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func cmdExists(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	keys, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	found := 0
+	for _, key := range keys {
+		ok, err := t.exists(key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found++
+		}
+	}
+	return found, nil
+}
+
+func cmdType(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := t.keyType(key)
+	if err != nil {
+		return nil, err
+	}
+	if typ == "" {
+		return "none", nil
+	}
+	return typ, nil
+}
+
+func cmdRename(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = t.rename(key, newKey)
+	if err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
@@ -2,22 +2,32 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
-	"encoding/json"
+	"encoding/hex"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
 	"log/slog"
 	"strconv"
 	"sync"
 )
 
 type UserDB struct {
-	db          *sql.DB
-	channels    map[string]chan string
-	channelsMux sync.Mutex
-	// TODO support both pubsub and mpmc channels
-	ctx    context.Context
-	logger *slog.Logger
+	db     *sql.DB
+	pubsub *broker
+	// origin identifies this UserDB in pubsub_messages.
+	origin string
+	// lastMessageID is the id of the last message in pubsub_messages that
+	// was relayed to the local broker.
+	lastMessageID int64
+	ctx           context.Context
+	cancel        context.CancelFunc
+	// workers tracks the background goroutines, which stop when ctx is done.
+	workers sync.WaitGroup
+	logger  *slog.Logger
+	// changed is closed and replaced whenever data was written, which wakes
+	// up blocking commands (see blocking.go).
+	changed    chan struct{}
+	changedMux sync.Mutex
 }
 
 var (
@@ -37,29 +47,163 @@ var (
 		    fromIP JSON,
 			options JSON NOT NULL DEFAULT '{}' -- raw options
 		);`,
+		`CREATE TABLE pubsub_messages( -- relays pubsub messages between processes sharing the database
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel TEXT NOT NULL,
+			message TEXT NOT NULL,
+			origin TEXT NOT NULL, -- the UserDB that published the message and already delivered it locally
+			created INTEGER NOT NULL -- unix milliseconds
+		);
+		CREATE INDEX pubsub_messages_created ON pubsub_messages(created);`,
+		`CREATE INDEX data_validUntil ON data(validUntil) WHERE validUntil != -1;`,
+		`CREATE TABLE counters( -- database-wide monotonic counters
+			name TEXT PRIMARY KEY,
+			value INTEGER NOT NULL
+		);
+		CREATE TABLE locks( -- leases on key names, kept apart from data so missing keys can be locked too
+			key TEXT PRIMARY KEY,
+			token INTEGER NOT NULL, -- fencing token
+			lockedUntil INTEGER NOT NULL -- unix milliseconds
+		);
+		CREATE INDEX locks_lockedUntil ON locks(lockedUntil);`,
+		`ALTER TABLE data ADD COLUMN version INTEGER NOT NULL DEFAULT 0; -- changes on every write, see versions.go
+		UPDATE data SET version = 1;
+		INSERT INTO counters(name, value) VALUES ('version', 1);`,
+		`CREATE TABLE config( -- database-wide settings changed with CONFIG SET
+			name TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		);`,
+		`CREATE TABLE json_schemas( -- JSON schemas validating the JSON documents in matching keys
+			pattern TEXT PRIMARY KEY, -- comma-separated pattern list
+			schema TEXT NOT NULL
+		);`,
+		`CREATE TABLE json_indexes( -- expression indexes on JSON documents created with JSON.INDEX
+			path TEXT PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE -- name of the index
+		);`,
+		`CREATE TABLE hashes( -- fields of keys of type hash
+			key TEXT NOT NULL REFERENCES data(key) ON DELETE CASCADE ON UPDATE CASCADE,
+			field TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY(key, field)
+		) WITHOUT ROWID;`,
+		`CREATE TABLE lists( -- elements of keys of type list
+			key TEXT NOT NULL REFERENCES data(key) ON DELETE CASCADE ON UPDATE CASCADE,
+			position INTEGER NOT NULL, -- orders the elements, see lists.go
+			value TEXT NOT NULL,
+			PRIMARY KEY(key, position)
+		) WITHOUT ROWID;`,
+		`CREATE TABLE sets( -- members of keys of type set
+			key TEXT NOT NULL REFERENCES data(key) ON DELETE CASCADE ON UPDATE CASCADE,
+			member TEXT NOT NULL,
+			PRIMARY KEY(key, member)
+		) WITHOUT ROWID;
+		CREATE TABLE zsets( -- members of keys of type zset
+			key TEXT NOT NULL REFERENCES data(key) ON DELETE CASCADE ON UPDATE CASCADE,
+			member TEXT NOT NULL,
+			score REAL NOT NULL,
+			PRIMARY KEY(key, member)
+		) WITHOUT ROWID;
+		CREATE INDEX zsets_score ON zsets(key, score, member);`,
+		`CREATE TABLE streams( -- see streams.go
+			name TEXT PRIMARY KEY,
+			persistent BOOL NOT NULL,
+			size INTEGER NOT NULL DEFAULT 0, -- maximum number of entries kept, 0 means unlimited
+			lastID INTEGER NOT NULL DEFAULT 0 -- id of the last entry appended
+		);
+		CREATE TABLE stream_entries( -- entries of persistent streams
+			stream TEXT NOT NULL REFERENCES streams(name) ON DELETE CASCADE,
+			id INTEGER NOT NULL,
+			time INTEGER NOT NULL, -- unix milliseconds
+			data TEXT NOT NULL,
+			PRIMARY KEY(stream, id)
+		) WITHOUT ROWID;
+		CREATE INDEX stream_entries_time ON stream_entries(stream, time);`,
+		`CREATE TABLE stream_groups( -- consumer groups of persistent streams, see streamgroups.go
+			stream TEXT NOT NULL REFERENCES streams(name) ON DELETE CASCADE,
+			name TEXT NOT NULL,
+			lastID INTEGER NOT NULL, -- id of the last entry delivered to the group
+			idleTimeout INTEGER NOT NULL, -- milliseconds after which unacknowledged entries are delivered again
+			maxDeliveries INTEGER NOT NULL DEFAULT 0, -- 0 means unlimited
+			deadLetter TEXT NOT NULL DEFAULT '', -- the stream that entries exceeding maxDeliveries are moved to
+			PRIMARY KEY(stream, name)
+		) WITHOUT ROWID;
+		CREATE TABLE stream_pending( -- entries delivered to a consumer group that were not acknowledged yet
+			stream TEXT NOT NULL,
+			grp TEXT NOT NULL,
+			id INTEGER NOT NULL,
+			consumer TEXT NOT NULL, -- the consumer the entry was last delivered to
+			deliveredAt INTEGER NOT NULL, -- unix milliseconds
+			deliveries INTEGER NOT NULL,
+			PRIMARY KEY(stream, grp, id),
+			FOREIGN KEY(stream, grp) REFERENCES stream_groups(stream, name) ON DELETE CASCADE,
+			FOREIGN KEY(stream, id) REFERENCES stream_entries(stream, id) ON DELETE CASCADE
+		) WITHOUT ROWID;
+		CREATE INDEX stream_pending_entry ON stream_pending(stream, id);
+		CREATE INDEX stream_pending_deliveredAt ON stream_pending(stream, grp, deliveredAt);`,
+		`ALTER TABLE streams ADD COLUMN mpmc BOOL NOT NULL DEFAULT FALSE;
+		CREATE TABLE queue_messages( -- messages of mpmc streams, see queues.go
+			stream TEXT NOT NULL REFERENCES streams(name) ON DELETE CASCADE,
+			id INTEGER NOT NULL,
+			priority INTEGER NOT NULL, -- messages with a higher priority are received first
+			visibleAt INTEGER NOT NULL, -- unix milliseconds, until then the message is delayed or leased
+			deliveries INTEGER NOT NULL DEFAULT 0, -- number of times the message was received
+			created INTEGER NOT NULL, -- unix milliseconds
+			data TEXT NOT NULL,
+			PRIMARY KEY(stream, id)
+		) WITHOUT ROWID;
+		CREATE INDEX queue_messages_priority ON queue_messages(stream, priority DESC, id);
+		CREATE INDEX queue_messages_visibleAt ON queue_messages(stream, visibleAt);`,
+		`CREATE TABLE scheduled( -- messages delivered later, see schedule.go
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel TEXT, -- the channel the message is published on
+			stream TEXT REFERENCES streams(name) ON DELETE CASCADE, -- or the stream it is appended to
+			message TEXT NOT NULL,
+			dueAt INTEGER NOT NULL, -- unix milliseconds
+			CHECK ((channel IS NULL) != (stream IS NULL))
+		);
+		CREATE INDEX scheduled_dueAt ON scheduled(dueAt);
+		CREATE INDEX scheduled_stream ON scheduled(stream) WHERE stream IS NOT NULL;`,
 	}
 )
 
-// TODO add custom funcs to handle string manipulation and maybe extend json handling
+// TODO maybe extend json handling with custom funcs (see sqlfuncs.go)
 // TODO implement all the data handling functions
 
 func NewUserDB(ctx context.Context, dbPath string, logger *slog.Logger) (*UserDB, error) {
-	db, err := sql.Open("sqlite3", dbPath+"?_fk=true&_timeout=5000&_journal_mode=WAL")
+	db, err := sql.Open(driverName, dbPath+"?_fk=true&_timeout=5000&_journal_mode=WAL&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("could not open database: %w", err)
 	}
 	db.SetMaxOpenConns(1)
 	db.SetMaxIdleConns(1)
+	origin := make([]byte, 8)
+	_, err = rand.Read(origin)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate origin: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	userDB := &UserDB{
-		db:       db,
-		ctx:      ctx,
-		logger:   logger,
-		channels: make(map[string]chan string),
+		db:      db,
+		ctx:     ctx,
+		cancel:  cancel,
+		logger:  logger,
+		pubsub:  newBroker(),
+		origin:  hex.EncodeToString(origin),
+		changed: make(chan struct{}),
 	}
 	err = userDB.applyMigrations()
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("could not apply migrations: %w", err)
 	}
+	err = userDB.startRelay()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("could not start pubsub relay: %w", err)
+	}
+	userDB.startReaper()
+	userDB.startScheduler()
 	return userDB, nil
 }
 
@@ -98,19 +242,23 @@ func (db *UserDB) applyMigrations() error {
 	return nil
 }
 
-// queryToJSON executes a SQL query and returns the result as a JSON string.
-func (db *UserDB) queryToJSON(query string, args ...any) (string, error) {
+// queryRows executes a SQL query and returns the result as a list of rows
+// mapping column names to values.
+func (db *UserDB) queryRows(query string, args ...any) ([]any, error) {
 	rows, err := db.db.Query(query, args...)
 	if err != nil {
-		return "", fmt.Errorf("error executing query %v: %w", query, err)
+		return nil, fmt.Errorf("error executing query %v: %w", query, err)
 	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
 	columnTypes, err := rows.ColumnTypes()
 	if err != nil {
-		return "", fmt.Errorf("error getting column types: %w", err)
+		return nil, fmt.Errorf("error getting column types: %w", err)
 	}
 
 	count := len(columnTypes)
-	var finalRows []interface{}
+	finalRows := []any{}
 
 	for rows.Next() {
 		scanArgs := make([]interface{}, count)
@@ -132,7 +280,7 @@ func (db *UserDB) queryToJSON(query string, args ...any) (string, error) {
 
 		err := rows.Scan(scanArgs...)
 		if err != nil {
-			return "", fmt.Errorf("error scanning row: %w", err)
+			return nil, fmt.Errorf("error scanning row: %w", err)
 		}
 
 		masterData := map[string]interface{}{}
@@ -168,25 +316,30 @@ func (db *UserDB) queryToJSON(query string, args ...any) (string, error) {
 
 		finalRows = append(finalRows, masterData)
 	}
-
-	z, err := json.MarshalIndent(finalRows, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("error marshalling json: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %w", err)
 	}
-	return string(z), nil
+	return finalRows, nil
 }
 
 func (db *UserDB) Close() error {
+	db.cancel()
+	db.workers.Wait()
 	return db.db.Close()
 }
 
-func (db *UserDB) GetChannel(channel string) chan string {
-	db.channelsMux.Lock()
-	defer db.channelsMux.Unlock()
-	ch, ok := db.channels[channel]
-	if !ok {
-		ch = make(chan string)
-		db.channels[channel] = ch
-	}
-	return ch
+// subscribe subscribes to channel with a queue of the given size.
+func (db *UserDB) subscribe(channel string, size int, policy SlowConsumerPolicy) *subscriber {
+	return db.pubsub.subscribe(channel, size, policy)
+}
+
+// psubscribe subscribes to all channels matching a comma-separated pattern
+// list with a queue of the given size.
+func (db *UserDB) psubscribe(pattern string, size int, policy SlowConsumerPolicy) (*subscriber, error) {
+	return db.pubsub.psubscribe(pattern, size, policy)
+}
+
+// unsubscribe closes a subscriber returned by subscribe or psubscribe.
+func (db *UserDB) unsubscribe(sub *subscriber) {
+	db.pubsub.unsubscribe(sub)
 }
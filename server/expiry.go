@@ -0,0 +1,249 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Keys expire at validUntil (unix milliseconds, -1 means never). Expired keys
+// are deleted lazily when they are accessed and by a background reaper that
+// purges them in bounded batches.
+
+const (
+	// reapInterval is how often the reaper looks for expired keys.
+	reapInterval = time.Second
+	// reapBatchSize is the maximum number of keys deleted per transaction.
+	reapBatchSize = 100
+	// reapMaxBatches is the maximum number of batches per reapInterval, so a
+	// large number of expired keys does not starve other commands.
+	reapMaxBatches = 10
+)
+
+// expire deletes key if it has expired.
+func (t *txn) expire(key string) error {
+	res, err := t.exec("DELETE FROM data WHERE key = ? AND validUntil != -1 AND validUntil <= ?;", key, t.now)
+	if err != nil {
+		return fmt.Errorf("could not expire key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("could not expire key: %w", err)
+	}
+	if n == 0 {
+		return nil
+	}
+	return t.notify("expired", key)
+}
+
+// setExpiry sets the expiry time of key in unix milliseconds (-1 means never)
+// and returns whether key exists. Keys with an expiry time in the past are
+// deleted. Like every write, it gives key a new version, so EXEC fails if key
+// is watched.
+func (t *txn) setExpiry(key string, validUntil int64) (bool, error) {
+	ok, err := t.exists(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return false, err
+	}
+	if validUntil != -1 && validUntil <= t.now {
+		return t.del(key)
+	}
+	_, err = t.exec("UPDATE data SET validUntil = ? WHERE key = ?;", validUntil, key)
+	if err != nil {
+		return false, fmt.Errorf("could not set expiry: %w", err)
+	}
+	_, err = t.bumpVersion(key)
+	if err != nil {
+		return false, err
+	}
+	if validUntil == -1 {
+		return true, t.notify("persist", key)
+	}
+	return true, t.notify("expire", key)
+}
+
+// getExpiry returns the expiry time of key in unix milliseconds (-1 means
+// never) and whether key exists.
+func (t *txn) getExpiry(key string) (int64, bool, error) {
+	ok, err := t.exists(key)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	var validUntil int64
+	err = t.queryRow("SELECT validUntil FROM data WHERE key = ?;", key).Scan(&validUntil)
+	if err != nil {
+		return 0, false, fmt.Errorf("could not get expiry: %w", err)
+	}
+	return validUntil, true, nil
+}
+
+// parseExpiry parses the i-th argument as the expiry time given in the unit of
+// option (EX, PX, EXAT or PXAT) and returns it in unix milliseconds.
+func (t *txn) parseExpiry(args []any, i int, option string) (int64, error) {
+	n, err := argInt(args, i)
+	if err != nil {
+		return 0, err
+	}
+	switch strings.ToUpper(option) {
+	case "EX":
+		return t.now + n*1000, nil
+	case "PX":
+		return t.now + n, nil
+	case "EXAT":
+		return n * 1000, nil
+	case "PXAT":
+		return n, nil
+	default:
+		return 0, fmt.Errorf("invalid expiry option: %s", option)
+	}
+}
+
+// expireCommand returns the implementation of EXPIRE, PEXPIRE, EXPIREAT and
+// PEXPIREAT, the unit of the timeout is given as option for parseExpiry. The
+// command returns 1 if the timeout was set and 0 if the key does not exist.
+func expireCommand(option string) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		if err := checkArgs(args, 2, 2); err != nil {
+			return nil, err
+		}
+		key, err := argString(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		validUntil, err := t.parseExpiry(args, 1, option)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := t.setExpiry(key, validUntil)
+		if err != nil || !ok {
+			return 0, err
+		}
+		return 1, nil
+	}
+}
+
+// ttlCommand returns the implementation of TTL and PTTL which return the
+// remaining time to live of a key in the given unit, -1 if the key does not
+// expire and -2 if it does not exist.
+func ttlCommand(unit time.Duration) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		if err := checkArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		key, err := argString(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		validUntil, ok, err := t.getExpiry(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return -2, nil
+		}
+		if validUntil == -1 {
+			return -1, nil
+		}
+		ms := int64(unit / time.Millisecond)
+		return (validUntil - t.now + ms/2) / ms, nil
+	}
+}
+
+// cmdPersist removes the expiry of a key and returns 1 if it had one.
+func cmdPersist(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	validUntil, ok, err := t.getExpiry(key)
+	if err != nil || !ok || validUntil == -1 {
+		return 0, err
+	}
+	_, err = t.setExpiry(key, -1)
+	if err != nil {
+		return nil, err
+	}
+	return 1, nil
+}
+
+// startReaper starts purging expired keys in the background.
+func (db *UserDB) startReaper() {
+	db.workers.Add(1)
+	go db.reap()
+}
+
+func (db *UserDB) reap() {
+	defer db.workers.Done()
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for i := 0; i < reapMaxBatches; i++ {
+			n, err := db.reapBatch()
+			if err != nil {
+				if db.ctx.Err() == nil {
+					db.logger.Error("Could not purge expired keys", "error", err)
+				}
+				break
+			}
+			if n > 0 {
+				db.logger.Debug("Purged expired keys", "count", n)
+			}
+			if n < reapBatchSize {
+				break
+			}
+		}
+		err := db.reapLocks()
+		if err != nil && db.ctx.Err() == nil {
+			db.logger.Error("Could not purge expired locks", "error", err)
+		}
+	}
+}
+
+// reapBatch deletes up to reapBatchSize expired keys and returns their number.
+func (db *UserDB) reapBatch() (int, error) {
+	var keys []string
+	err := db.update(db.ctx, func(t *txn) error {
+		rows, err := t.query(`SELECT key FROM data WHERE validUntil != -1 AND validUntil <= ?
+			ORDER BY validUntil LIMIT ?;`, t.now, reapBatchSize)
+		if err != nil {
+			return fmt.Errorf("could not query expired keys: %w", err)
+		}
+		for rows.Next() {
+			var key string
+			err = rows.Scan(&key)
+			if err != nil {
+				_ = rows.Close()
+				return fmt.Errorf("could not scan expired key: %w", err)
+			}
+			keys = append(keys, key)
+		}
+		if err = rows.Err(); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("could not query expired keys: %w", err)
+		}
+		err = rows.Close()
+		if err != nil {
+			return fmt.Errorf("could not query expired keys: %w", err)
+		}
+		for _, key := range keys {
+			err = t.expire(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(keys), err
+}
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/tionis/ssh-data/util"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The fields of a hash are stored in the hashes table, one row per field. The
+// row of the key in data only carries the type, expiry and version, so
+// deleting, expiring or renaming the key cascades to its fields.
+
+// getField returns the value of a field of a hash and whether it exists.
+func (t *txn) getField(key, field string) (string, bool, error) {
+	ok, err := t.checkType(key, typeHash)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	var value string
+	err = t.queryRow("SELECT value FROM hashes WHERE key = ? AND field = ?;", key, field).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("could not get field: %w", err)
+	}
+	return value, true, nil
+}
+
+// setField sets a field of a hash without recording the modification of key,
+// which the caller has to do. It returns whether the field is new.
+func (t *txn) setField(key, field, value string) (bool, error) {
+	err := t.createKey(key, typeHash)
+	if err != nil {
+		return false, err
+	}
+	var existed bool
+	err = t.queryRow("SELECT EXISTS (SELECT 1 FROM hashes WHERE key = ? AND field = ?);", key, field).Scan(&existed)
+	if err != nil {
+		return false, fmt.Errorf("could not set field: %w", err)
+	}
+	_, err = t.exec(`INSERT INTO hashes(key, field, value) VALUES (?, ?, ?)
+		ON CONFLICT(key, field) DO UPDATE SET value = excluded.value;`, key, field, value)
+	if err != nil {
+		return false, fmt.Errorf("could not set field: %w", err)
+	}
+	return !existed, nil
+}
+
+// cmdHSet implements HSET key field value [field value]... and returns the
+// number of fields that were added.
+func cmdHSet(t *txn, args []any) (any, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return nil, errWrongNumberOfArguments
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	key := strs[0]
+	var added int64
+	for i := 1; i < len(strs); i += 2 {
+		isNew, err := t.setField(key, strs[i], strs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		if isNew {
+			added++
+		}
+	}
+	return added, t.modified(key, "hset")
+}
+
+// cmdHSetNX implements HSETNX key field value, which only sets field if it
+// does not exist yet. It returns 1 if the field was set and 0 otherwise.
+func cmdHSetNX(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, ok, err := t.getField(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return 0, nil
+	}
+	_, err = t.setField(strs[0], strs[1], strs[2])
+	if err != nil {
+		return nil, err
+	}
+	return 1, t.modified(strs[0], "hset")
+}
+
+// cmdHGet implements HGET key field.
+func cmdHGet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	value, ok, err := t.getField(strs[0], strs[1])
+	if err != nil || !ok {
+		return nil, err
+	}
+	return value, nil
+}
+
+// cmdHMGet implements HMGET key field [field]..., missing fields are nil.
+func cmdHMGet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, -1); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, 0, len(strs)-1)
+	for _, field := range strs[1:] {
+		value, ok, err := t.getField(strs[0], field)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values = append(values, value)
+		} else {
+			values = append(values, nil)
+		}
+	}
+	return values, nil
+}
+
+// hashFields returns the fields and values of a hash in field order.
+func (t *txn) hashFields(key string) ([][2]string, error) {
+	ok, err := t.checkType(key, typeHash)
+	if err != nil || !ok {
+		return nil, err
+	}
+	rows, err := t.query("SELECT field, value FROM hashes WHERE key = ? ORDER BY field;", key)
+	if err != nil {
+		return nil, fmt.Errorf("could not get fields: %w", err)
+	}
+	defer rows.Close()
+	var fields [][2]string
+	for rows.Next() {
+		var field [2]string
+		err = rows.Scan(&field[0], &field[1])
+		if err != nil {
+			return nil, fmt.Errorf("could not get fields: %w", err)
+		}
+		fields = append(fields, field)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not get fields: %w", err)
+	}
+	return fields, nil
+}
+
+// cmdHGetAll implements HGETALL key and returns the hash as an object.
+func cmdHGetAll(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := t.hashFields(key)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]any, len(fields))
+	for _, field := range fields {
+		result[field[0]] = field[1]
+	}
+	return result, nil
+}
+
+// hashListCommand returns the implementation of HKEYS (i = 0) and HVALS
+// (i = 1), which list the fields or values of a hash in field order.
+func hashListCommand(i int) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		if err := checkArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		key, err := argString(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := t.hashFields(key)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]any, 0, len(fields))
+		for _, field := range fields {
+			result = append(result, field[i])
+		}
+		return result, nil
+	}
+}
+
+// cmdHDel implements HDEL key field [field]... and returns the number of
+// fields that were removed. The key is deleted with its last field.
+func cmdHDel(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, -1); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	key := strs[0]
+	ok, err := t.checkType(key, typeHash)
+	if err != nil || !ok {
+		return 0, err
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return nil, err
+	}
+	var removed int64
+	for _, field := range strs[1:] {
+		res, err := t.exec("DELETE FROM hashes WHERE key = ? AND field = ?;", key, field)
+		if err != nil {
+			return nil, fmt.Errorf("could not delete field: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("could not delete field: %w", err)
+		}
+		removed += n
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	err = t.modified(key, "hdel")
+	if err != nil {
+		return nil, err
+	}
+	return removed, t.deleteIfEmpty(key, "hashes")
+}
+
+// cmdHLen implements HLEN key and returns the number of fields.
+func cmdHLen(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := t.checkType(key, typeHash)
+	if err != nil || !ok {
+		return 0, err
+	}
+	var n int64
+	err = t.queryRow("SELECT count(*) FROM hashes WHERE key = ?;", key).Scan(&n)
+	if err != nil {
+		return nil, fmt.Errorf("could not count fields: %w", err)
+	}
+	return n, nil
+}
+
+// cmdHExists implements HEXISTS key field and returns 1 if the field exists
+// and 0 otherwise.
+func cmdHExists(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, ok, err := t.getField(strs[0], strs[1])
+	if err != nil || !ok {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// cmdHIncrBy implements HINCRBY key field increment, missing fields count as
+// 0. It returns the new value.
+func cmdHIncrBy(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := argInt(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	value, ok, err := t.getField(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	var n int64
+	if ok {
+		n, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.New("value is not an integer or out of range")
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return nil, errors.New("increment or decrement would overflow")
+	}
+	n += delta
+	_, err = t.setField(strs[0], strs[1], strconv.FormatInt(n, 10))
+	if err != nil {
+		return nil, err
+	}
+	return n, t.modified(strs[0], "hincrby")
+}
+
+// cmdHIncrByFloat implements HINCRBYFLOAT key field increment and returns the
+// new value as a string.
+func cmdHIncrByFloat(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := strconv.ParseFloat(strs[2], 64)
+	if err != nil {
+		return nil, errors.New("invalid argument 3: expected float")
+	}
+	value, ok, err := t.getField(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	var f float64
+	if ok {
+		f, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, errors.New("value is not a valid float")
+		}
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New("increment would produce NaN or Infinity")
+	}
+	result := strconv.FormatFloat(f, 'f', -1, 64)
+	_, err = t.setField(strs[0], strs[1], result)
+	if err != nil {
+		return nil, err
+	}
+	return result, t.modified(strs[0], "hincrbyfloat")
+}
+
+// cmdHScan implements HSCAN key cursor [MATCH patterns] [COUNT n]. Like SCAN
+// it walks the fields in order with the last field examined as cursor, and
+// returns a list of the next cursor followed by the matching fields and their
+// values.
+func cmdHScan(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 6); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	key, cursor := strs[0], strs[1]
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []*util.Pattern
+	count := int64(defaultScanCount)
+	for i := 2; i < len(strs); i += 2 {
+		if i+1 >= len(strs) {
+			return nil, errors.New("syntax error")
+		}
+		switch option := strings.ToUpper(strs[i]); option {
+		case "MATCH":
+			patterns, err = util.ParsePatternList(strs[i+1])
+		case "COUNT":
+			count, err = argInt(args, i+1)
+			if err == nil && count < 1 {
+				err = errors.New("COUNT must be positive")
+			}
+		default:
+			err = fmt.Errorf("invalid option: %s", option)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	result := []any{"0"}
+	ok, err := t.checkType(key, typeHash)
+	if err != nil || !ok {
+		return result, err
+	}
+	query := "SELECT field, value FROM hashes WHERE key = ?"
+	queryArgs := []any{key}
+	if cursor != "0" {
+		query += " AND field > ?"
+		queryArgs = append(queryArgs, after)
+	}
+	rows, err := t.query(query+" ORDER BY field LIMIT ?;", append(queryArgs, count)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not scan fields: %w", err)
+	}
+	defer rows.Close()
+	var n int64
+	var last string
+	for rows.Next() {
+		var field, value string
+		err = rows.Scan(&field, &value)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan fields: %w", err)
+		}
+		n++
+		last = field
+		if patterns != nil && !util.MatchPatternList(patterns, field) {
+			continue
+		}
+		result = append(result, field, value)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan fields: %w", err)
+	}
+	if n == count {
+		result[0] = encodeCursor(last)
+	}
+	return result, nil
+}
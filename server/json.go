@@ -0,0 +1,611 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON documents are stored as minified JSON text in keys of type json and
+// manipulated with the JSON functions of sqlite. Paths use the JSONPath-like
+// syntax of sqlite ("$.a.b[0]"), the leading "$" may be omitted and "." is
+// the root.
+
+var errInvalidJSON = errors.New("invalid JSON")
+
+// jsonPath converts a path as given by clients to an sqlite JSON path.
+func jsonPath(path string) string {
+	switch {
+	case path == "" || path == "." || path == "$":
+		return "$"
+	case strings.HasPrefix(path, "$"):
+		return path
+	case strings.HasPrefix(path, ".") || strings.HasPrefix(path, "["):
+		return "$" + path
+	default:
+		return "$." + path
+	}
+}
+
+// argPath returns the i-th argument as sqlite JSON path or the root if there
+// is no i-th argument.
+func argPath(args []any, i int) (string, error) {
+	if i >= len(args) {
+		return "$", nil
+	}
+	path, err := argString(args, i)
+	if err != nil {
+		return "", err
+	}
+	return jsonPath(path), nil
+}
+
+// argJSON returns the i-th argument as JSON text. In JSON mode arguments that
+// are not strings are taken as they are, so documents can be sent without
+// quoting them.
+func argJSON(args []any, i int) (string, error) {
+	var value string
+	if s, ok := args[i].(string); ok {
+		value = s
+	} else {
+		b, err := json.Marshal(args[i])
+		if err != nil {
+			return "", fmt.Errorf("invalid argument %d: %w", i+1, err)
+		}
+		value = string(b)
+	}
+	if !json.Valid([]byte(value)) {
+		return "", errInvalidJSON
+	}
+	return value, nil
+}
+
+// jsonType returns the sqlite JSON type of the value at path in the JSON
+// document in key, "" if key or path does not exist.
+func (t *txn) jsonType(key, path string) (string, error) {
+	ok, err := t.checkType(key, typeJSON)
+	if err != nil || !ok {
+		return "", err
+	}
+	var typ sql.NullString
+	err = t.queryRow("SELECT json_type(value, ?) FROM data WHERE key = ?;", path, key).Scan(&typ)
+	if err != nil {
+		return "", fmt.Errorf("could not get JSON type: %w", err)
+	}
+	return typ.String, nil
+}
+
+// getJSON returns the JSON text at path in the JSON document in key and
+// whether it exists.
+func (t *txn) getJSON(key, path string) (json.RawMessage, bool, error) {
+	ok, err := t.checkType(key, typeJSON)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	var value sql.NullString
+	err = t.queryRow("SELECT value -> ? FROM data WHERE key = ?;", path, key).Scan(&value)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not get JSON value: %w", err)
+	}
+	if !value.Valid {
+		return nil, false, nil
+	}
+	return json.RawMessage(value.String), true, nil
+}
+
+// setJSON stores a JSON document in key, which must not hold another type.
+// The expiry of existing documents is kept.
+func (t *txn) setJSON(key, value string) error {
+	return t.updateJSON(key, "json(?)", value)
+}
+
+// updateJSON sets the JSON document in key, which must not hold another type,
+// to the result of the SQL expression expr, which may refer to the current
+// document as value. Missing keys are created with the result of expr applied
+// to null.
+func (t *txn) updateJSON(key, expr string, args ...any) error {
+	err := t.checkLock(key)
+	if err != nil {
+		return err
+	}
+	_, err = t.exec(`INSERT INTO data(key, type, value) VALUES (?, ?, 'null')
+		ON CONFLICT(key) DO NOTHING;`, key, typeJSON)
+	if err != nil {
+		return fmt.Errorf("could not set key: %w", err)
+	}
+	_, err = t.exec("UPDATE data SET value = "+expr+" WHERE key = ?;", append(args, key)...)
+	if err != nil {
+		return fmt.Errorf("could not set JSON value: %w", err)
+	}
+	err = t.validateJSON(key)
+	if err != nil {
+		return err
+	}
+	_, err = t.bumpVersion(key)
+	if err != nil {
+		return err
+	}
+	return t.notify("set", key)
+}
+
+// cmdJSONSet implements JSON.SET key path value [NX|XX]. New documents must
+// be created at the root. It returns nil if the value was not set because of
+// NX or XX or because the parent of path does not exist.
+func cmdJSONSet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 4); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	value, err := argJSON(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	var nx, xx bool
+	if len(args) == 4 {
+		option, err := argString(args, 3)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(option) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		default:
+			return nil, fmt.Errorf("invalid option: %s", option)
+		}
+	}
+	typ, err := t.jsonType(key, path)
+	if err != nil {
+		return nil, err
+	}
+	if (nx && typ != "") || (xx && typ == "") {
+		return nil, nil
+	}
+	if path == "$" {
+		return "OK", t.setJSON(key, value)
+	}
+	ok, err := t.exists(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("new documents must be created at the root")
+	}
+	if typ == "" {
+		// json_set silently ignores paths whose parent does not exist.
+		parent, _, err := t.getJSON(key, jsonParent(path))
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			return nil, nil
+		}
+	}
+	err = t.updateJSON(key, "json_set(value, ?, json(?))", path, value)
+	if err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
+
+// jsonParent returns the path of the parent of the value at path.
+func jsonParent(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i <= 0 {
+		return "$"
+	}
+	return path[:i]
+}
+
+// cmdJSONGet implements JSON.GET key [path...]. With a single path it returns
+// the JSON value at it, with multiple paths an object mapping the paths to
+// their values. It returns nil if key or a single path does not exist.
+func cmdJSONGet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) <= 2 {
+		path, err := argPath(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		value, ok, err := t.getJSON(key, path)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return value, nil
+	}
+	ok, err := t.checkType(key, typeJSON)
+	if err != nil || !ok {
+		return nil, err
+	}
+	values := make(map[string]json.RawMessage, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		p, err := argString(args, i)
+		if err != nil {
+			return nil, err
+		}
+		value, ok, err := t.getJSON(key, jsonPath(p))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			value = json.RawMessage("null")
+		}
+		values[p] = value
+	}
+	return values, nil
+}
+
+// cmdJSONDel implements JSON.DEL key [path]. Deleting the root deletes the
+// key. It returns the number of deleted values.
+func cmdJSONDel(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := t.jsonType(key, path)
+	if err != nil || typ == "" {
+		return 0, err
+	}
+	if path == "$" {
+		_, err = t.del(key)
+	} else {
+		err = t.updateJSON(key, "json_remove(value, ?)", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return 1, nil
+}
+
+// jsonTypeNames maps the JSON types of sqlite to the names returned by
+// JSON.TYPE.
+var jsonTypeNames = map[string]string{
+	"object":  "object",
+	"array":   "array",
+	"integer": "integer",
+	"real":    "number",
+	"text":    "string",
+	"true":    "boolean",
+	"false":   "boolean",
+	"null":    "null",
+}
+
+// cmdJSONType implements JSON.TYPE key [path] and returns the type of the
+// value at path or nil if it does not exist.
+func cmdJSONType(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := t.jsonType(key, path)
+	if err != nil || typ == "" {
+		return nil, err
+	}
+	return jsonTypeNames[typ], nil
+}
+
+// checkJSONType returns an error unless the value at path in key exists and
+// has the sqlite JSON type typ.
+func (t *txn) checkJSONType(key, path string, typ ...string) error {
+	actual, err := t.jsonType(key, path)
+	if err != nil {
+		return err
+	}
+	if actual == "" {
+		return errors.New("no such key or path")
+	}
+	for _, typ := range typ {
+		if actual == typ {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid type of value at %s: %s", path, jsonTypeNames[actual])
+}
+
+// cmdJSONArrAppend implements JSON.ARRAPPEND key path value... and returns
+// the new length of the array.
+func cmdJSONArrAppend(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, -1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = t.checkJSONType(key, path, "array")
+	if err != nil {
+		return nil, err
+	}
+	// all values are appended by a single json_insert, so the document is
+	// only validated and versioned once
+	expr := "json_insert(value" + strings.Repeat(", ?, json(?)", len(args)-2) + ")"
+	var exprArgs []any
+	for i := 2; i < len(args); i++ {
+		value, err := argJSON(args, i)
+		if err != nil {
+			return nil, err
+		}
+		exprArgs = append(exprArgs, path+"[#]", value)
+	}
+	err = t.updateJSON(key, expr, exprArgs...)
+	if err != nil {
+		return nil, err
+	}
+	var length int64
+	err = t.queryRow("SELECT json_array_length(value, ?) FROM data WHERE key = ?;", path, key).Scan(&length)
+	if err != nil {
+		return nil, fmt.Errorf("could not get array length: %w", err)
+	}
+	return length, nil
+}
+
+// cmdJSONArrPop implements JSON.ARRPOP key [path [index]], which removes the
+// element at index (default -1, negative indexes count from the end) from the
+// array and returns it. It returns nil if the array is empty.
+func cmdJSONArrPop(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	index := int64(-1)
+	if len(args) == 3 {
+		index, err = argInt(args, 2)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = t.checkJSONType(key, path, "array")
+	if err != nil {
+		return nil, err
+	}
+	var length int64
+	err = t.queryRow("SELECT json_array_length(value, ?) FROM data WHERE key = ?;", path, key).Scan(&length)
+	if err != nil {
+		return nil, fmt.Errorf("could not get array length: %w", err)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	if index < 0 {
+		index = max(length+index, 0)
+	}
+	index = min(index, length-1)
+	element := path + "[" + strconv.FormatInt(index, 10) + "]"
+	value, _, err := t.getJSON(key, element)
+	if err != nil {
+		return nil, err
+	}
+	err = t.updateJSON(key, "json_remove(value, ?)", element)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// cmdJSONNumIncrBy implements JSON.NUMINCRBY key path number and returns the
+// new value.
+func cmdJSONNumIncrBy(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	s, err := argString(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	var delta any
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		delta = n
+	} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+		delta = f
+	} else {
+		return nil, errors.New("invalid argument 3: expected number")
+	}
+	err = t.checkJSONType(key, path, "integer", "real")
+	if err != nil {
+		return nil, err
+	}
+	err = t.updateJSON(key, "json_set(value, ?1, json_extract(value, ?1) + ?2)", path, delta)
+	if err != nil {
+		return nil, err
+	}
+	value, _, err := t.getJSON(key, path)
+	return value, err
+}
+
+// cmdJSONObjKeys implements JSON.OBJKEYS key [path] and returns the keys of
+// the object at path.
+func cmdJSONObjKeys(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := t.jsonType(key, path)
+	if err != nil || typ == "" {
+		return nil, err
+	}
+	if typ != "object" {
+		return nil, fmt.Errorf("invalid type of value at %s: %s", path, jsonTypeNames[typ])
+	}
+	rows, err := t.query("SELECT j.key FROM data, json_each(data.value, ?) AS j WHERE data.key = ?;", path, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not get object keys: %w", err)
+	}
+	defer rows.Close()
+	keys := []any{}
+	for rows.Next() {
+		var k string
+		err = rows.Scan(&k)
+		if err != nil {
+			return nil, fmt.Errorf("could not get object keys: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not get object keys: %w", err)
+	}
+	return keys, nil
+}
+
+// cmdJSONMerge implements JSON.MERGE key path patch, which applies a JSON
+// Merge Patch (RFC 7396) to the value at path, and returns the resulting
+// document. New documents must be created at the root.
+func cmdJSONMerge(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := argJSON(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := t.jsonType(key, path)
+	if err != nil {
+		return nil, err
+	}
+	if path == "$" {
+		err = t.updateJSON(key, "json_patch(value, json(?))", patch)
+	} else {
+		var ok bool
+		ok, err = t.exists(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("new documents must be created at the root")
+		}
+		if typ == "" {
+			_, ok, err = t.getJSON(key, jsonParent(path))
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, errors.New("no such path")
+			}
+		}
+		err = t.updateJSON(key, "json_set(value, ?1, json_patch(coalesce(value -> ?1, 'null'), json(?2)))", path, patch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, _, err := t.getJSON(key, "$")
+	return value, err
+}
+
+// cmdJSONPatch implements JSON.PATCH key patch, which applies a JSON Patch
+// (RFC 6902) to the document in key, a missing key being a null document. If
+// an operation fails (including test operations whose value does not match),
+// nothing is changed. It returns the resulting document.
+func cmdJSONPatch(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	patchJSON, err := argJSON(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	var patch []patchOperation
+	err = json.Unmarshal([]byte(patchJSON), &patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON patch: %w", err)
+	}
+	current, ok, err := t.getJSON(key, "$")
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if ok {
+		doc, err = decodeOrderedJSON(current)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode document: %w", err)
+		}
+	}
+	doc, i, err := applyPatch(doc, patch)
+	if err != nil {
+		code := "PATCH"
+		if errors.Is(err, errTestFailed) {
+			code = "TESTFAILED"
+		}
+		return nil, &commandError{
+			code:    code,
+			message: fmt.Sprintf("operation %d (%s %s) failed: %v", i+1, patch[i].Op, patch[i].Path, err),
+			data:    map[string]any{"index": i, "op": patch[i].Op, "path": patch[i].Path},
+		}
+	}
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode document: %w", err)
+	}
+	err = t.setJSON(key, string(value))
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(value), nil
+}
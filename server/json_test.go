@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDB opens a UserDB in a temporary directory that is closed when the
+// test ends.
+func newTestDB(t *testing.T) *UserDB {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db, err := NewUserDB(context.Background(), filepath.Join(t.TempDir(), "test.db"), logger)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+// run executes a data command in its own transaction.
+func run(db *UserDB, name string, args ...any) (any, error) {
+	var result any
+	err := db.update(context.Background(), func(t *txn) (err error) {
+		result, err = dataCommands[name](t, args)
+		return err
+	})
+	return result, err
+}
+
+// mustRun is like run but fails the test on errors.
+func mustRun(t *testing.T, db *UserDB, name string, args ...any) any {
+	t.Helper()
+	result, err := run(db, name, args...)
+	if err != nil {
+		t.Fatalf("%s %v: %v", name, args, err)
+	}
+	return result
+}
+
+func TestJSONMergeSubPathLocked(t *testing.T) {
+	db := newTestDB(t)
+	mustRun(t, db, "json.set", "d", "$", `{"a":{"b":1}}`)
+	token := mustRun(t, db, "lock", "d", "100000")
+	_, err := run(db, "json.merge", "d", ".a", `{"b":2}`)
+	if !errors.Is(err, errLocked) {
+		t.Fatalf("expected %v, got %v", errLocked, err)
+	}
+	mustRun(t, db, "unlock", "d", fmt.Sprint(token))
+	if doc := fmt.Sprintf("%s", mustRun(t, db, "json.get", "d")); doc != `{"a":{"b":1}}` {
+		t.Fatalf("document changed: %v", doc)
+	}
+}
+
+func TestJSONMergeSubPathSchema(t *testing.T) {
+	db := newTestDB(t)
+	mustRun(t, db, "json.schema", "SET", "cfg*",
+		`{"properties":{"a":{"properties":{"b":{"type":"integer"}}}}}`)
+	mustRun(t, db, "json.set", "cfg1", "$", `{"a":{"b":1}}`)
+	_, err := run(db, "json.merge", "cfg1", ".a", `{"b":"notint"}`)
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) || cmdErr.code != "SCHEMA" {
+		t.Fatalf("expected a SCHEMA error, got %v", err)
+	}
+	if doc := fmt.Sprintf("%s", mustRun(t, db, "json.get", "cfg1")); doc != `{"a":{"b":1}}` {
+		t.Fatalf("document changed: %v", doc)
+	}
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// JSON.FIND filters the JSON documents under a prefix with SQL conditions on
+// json_extract(value, path). Paths are inlined as SQL literals instead of being
+// bound, as sqlite only uses an expression index (created by JSON.INDEX) if
+// the expression of the query is identical to the indexed one.
+
+const defaultFindLimit = 100
+
+// findOperators maps the operators of FILTER to SQL, in is handled separately.
+var findOperators = map[string]string{
+	"eq":  "=",
+	"ne":  "!=",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+}
+
+// sqlString quotes s as SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// jsonPathPattern matches the sqlite JSON paths that are accepted by FIND and
+// INDEX, sqlite itself only reports invalid paths once it evaluates them.
+var jsonPathPattern = regexp.MustCompile(`^\$(\.("[^"]*"|[^."\[\]]+)|\[(\d+|#(-\d+)?)\])*$`)
+
+// jsonExtract returns the SQL expression extracting path from the value of a
+// JSON document.
+func jsonExtract(path string) (string, error) {
+	if !jsonPathPattern.MatchString(path) {
+		return "", fmt.Errorf("invalid path: %s", path)
+	}
+	return "json_extract(value, " + sqlString(path) + ")", nil
+}
+
+// argFilterValue returns the i-th argument as decoded JSON value. Strings are
+// parsed as JSON if possible and taken as they are otherwise, so text mode
+// clients do not have to quote strings.
+func argFilterValue(args []any, i int) any {
+	if s, ok := args[i].(string); ok {
+		decoded, err := decodeJSON([]byte(s))
+		if err != nil {
+			return s
+		}
+		return decoded
+	}
+	return args[i]
+}
+
+// filterValue converts a decoded JSON value to the SQL value json_extract
+// returns for it.
+func filterValue(v any) (any, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	default:
+		return v, nil
+	}
+}
+
+// cmdJSONFind implements JSON.FIND [PREFIX prefix] [FILTER path op [value]]...
+// [SORTBY path [ASC|DESC]] [LIMIT n]. It returns the JSON documents in keys
+// starting with prefix that match all filters as list of objects with the key
+// and the value. The operators are eq, ne, lt, lte, gt, gte, in (with a JSON
+// array as value) and exists (without a value).
+func cmdJSONFind(t *txn, args []any) (any, error) {
+	query := "SELECT key, value FROM data WHERE type = 'json' AND (validUntil = -1 OR validUntil > ?)"
+	queryArgs := []any{t.now}
+	order := " ORDER BY key"
+	limit := int64(defaultFindLimit)
+	for i := 0; i < len(args); {
+		option, err := argString(args, i)
+		if err != nil {
+			return nil, err
+		}
+		i++
+		switch strings.ToUpper(option) {
+		case "PREFIX":
+			if i >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			prefix, err := argString(args, i)
+			if err != nil {
+				return nil, err
+			}
+			i++
+			query += " AND key >= ?"
+			queryArgs = append(queryArgs, prefix)
+			if end := prefixEnd(prefix); end != "" {
+				query += " AND key < ?"
+				queryArgs = append(queryArgs, end)
+			}
+		case "FILTER":
+			if i+1 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			path, err := argPath(args, i)
+			if err != nil {
+				return nil, err
+			}
+			op, err := argString(args, i+1)
+			if err != nil {
+				return nil, err
+			}
+			i += 2
+			expr, err := jsonExtract(path)
+			if err != nil {
+				return nil, err
+			}
+			op = strings.ToLower(op)
+			if op == "exists" {
+				query += " AND json_type(value, " + sqlString(path) + ") IS NOT NULL"
+				continue
+			}
+			if i >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			value := argFilterValue(args, i)
+			i++
+			if op == "in" {
+				items, ok := value.([]any)
+				if !ok || len(items) == 0 {
+					return nil, errors.New("the value of in must be a non-empty JSON array")
+				}
+				query += " AND " + expr + " IN (?" + strings.Repeat(", ?", len(items)-1) + ")"
+				for _, item := range items {
+					item, err = filterValue(item)
+					if err != nil {
+						return nil, err
+					}
+					queryArgs = append(queryArgs, item)
+				}
+				continue
+			}
+			operator, ok := findOperators[op]
+			if !ok {
+				return nil, fmt.Errorf("invalid operator: %s", op)
+			}
+			if value == nil {
+				if op != "eq" && op != "ne" {
+					return nil, errors.New("null can only be compared with eq and ne")
+				}
+				query += " AND json_type(value, " + sqlString(path) + ") " + operator + " 'null'"
+				continue
+			}
+			value, err = filterValue(value)
+			if err != nil {
+				return nil, err
+			}
+			query += " AND " + expr + " " + operator + " ?"
+			queryArgs = append(queryArgs, value)
+		case "SORTBY":
+			if i >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			path, err := argPath(args, i)
+			if err != nil {
+				return nil, err
+			}
+			i++
+			expr, err := jsonExtract(path)
+			if err != nil {
+				return nil, err
+			}
+			direction := "ASC"
+			if i < len(args) {
+				if d, ok := args[i].(string); ok && (strings.EqualFold(d, "ASC") || strings.EqualFold(d, "DESC")) {
+					direction = strings.ToUpper(d)
+					i++
+				}
+			}
+			order = " ORDER BY " + expr + " " + direction + ", key"
+		case "LIMIT":
+			if i >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			limit, err = argInt(args, i)
+			if err != nil {
+				return nil, err
+			}
+			if limit < 1 {
+				return nil, errors.New("LIMIT must be positive")
+			}
+			i++
+		default:
+			return nil, fmt.Errorf("invalid option: %s", option)
+		}
+	}
+	rows, err := t.query(query+order+" LIMIT ?;", append(queryArgs, limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not find documents: %w", err)
+	}
+	defer rows.Close()
+	documents := []any{}
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return nil, fmt.Errorf("could not find documents: %w", err)
+		}
+		documents = append(documents, map[string]any{"key": key, "value": json.RawMessage(value)})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not find documents: %w", err)
+	}
+	return documents, nil
+}
+
+// cmdJSONIndex implements JSON.INDEX CREATE path, JSON.INDEX DROP path and
+// JSON.INDEX LIST, which manage expression indexes on json_extract(value,
+// path) over all JSON documents.
+func cmdJSONIndex(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	subcommand, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	subcommand = strings.ToUpper(subcommand)
+	if subcommand == "LIST" {
+		if len(args) != 1 {
+			return nil, errWrongNumberOfArguments
+		}
+		rows, err := t.query("SELECT path FROM json_indexes ORDER BY path;")
+		if err != nil {
+			return nil, fmt.Errorf("could not list indexes: %w", err)
+		}
+		defer rows.Close()
+		paths := []any{}
+		for rows.Next() {
+			var path string
+			err = rows.Scan(&path)
+			if err != nil {
+				return nil, fmt.Errorf("could not list indexes: %w", err)
+			}
+			paths = append(paths, path)
+		}
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("could not list indexes: %w", err)
+		}
+		return paths, nil
+	}
+	if len(args) != 2 {
+		return nil, errWrongNumberOfArguments
+	}
+	path, err := argPath(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	// The name is derived from the path so it is a valid identifier.
+	name := "json_index_" + hex.EncodeToString([]byte(path))
+	switch subcommand {
+	case "CREATE":
+		expr, err := jsonExtract(path)
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.exec("CREATE INDEX IF NOT EXISTS " + name + " ON data(" + expr + ") WHERE type = 'json';")
+		if err != nil {
+			return nil, fmt.Errorf("could not create index: %w", err)
+		}
+		_, err = t.exec("INSERT INTO json_indexes(path, name) VALUES (?, ?) ON CONFLICT(path) DO NOTHING;", path, name)
+		if err != nil {
+			return nil, fmt.Errorf("could not create index: %w", err)
+		}
+		return "OK", nil
+	case "DROP":
+		res, err := t.exec("DELETE FROM json_indexes WHERE path = ?;", path)
+		if err != nil {
+			return nil, fmt.Errorf("could not drop index: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("could not drop index: %w", err)
+		}
+		_, err = t.exec("DROP INDEX IF EXISTS " + name + ";")
+		if err != nil {
+			return nil, fmt.Errorf("could not drop index: %w", err)
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("invalid subcommand: %s", subcommand)
+	}
+}
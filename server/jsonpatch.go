@@ -0,0 +1,437 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON Patch (RFC 6902) is applied in Go on the decoded document, numbers are
+// kept as json.Number so they are stored exactly as they were sent and objects
+// are decoded as jsonObject so they keep the order of their members (like
+// JSON.MERGE, which uses json_patch in sqlite).
+
+// patchOperation is a single operation of a JSON Patch.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// decodeJSON decodes JSON text keeping numbers as json.Number.
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	err := decoder.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// jsonObject is a decoded JSON object that keeps the order of its members.
+type jsonObject struct {
+	keys   []string
+	values map[string]any
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: make(map[string]any)}
+}
+
+// set sets the member key to value, new members are added at the end.
+func (o *jsonObject) set(key string, value any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// remove removes the member key and returns whether it existed.
+func (o *jsonObject) remove(key string) bool {
+	if _, ok := o.values[key]; !ok {
+		return false
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodeOrderedJSON decodes JSON text like decodeJSON, but returns objects as
+// jsonObject.
+func decodeOrderedJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decodeOrderedValue(decoder)
+}
+
+func decodeOrderedValue(decoder *json.Decoder) (any, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		o := newJSONObject()
+		for decoder.More() {
+			token, err = decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			// object keys are always returned as strings
+			key := token.(string)
+			value, err := decodeOrderedValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			o.set(key, value)
+		}
+		_, err = decoder.Token()
+		return o, err
+	case json.Delim('['):
+		a := []any{}
+		for decoder.More() {
+			value, err := decodeOrderedValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, value)
+		}
+		_, err = decoder.Token()
+		return a, err
+	default:
+		return token, nil
+	}
+}
+
+// applyPatch applies the operations of patch to doc in order and returns the
+// resulting document. If an operation fails, the error is returned together
+// with the index of the operation.
+func applyPatch(doc any, patch []patchOperation) (any, int, error) {
+	for i, op := range patch {
+		var err error
+		doc, err = applyPatchOperation(doc, op)
+		if err != nil {
+			return nil, i, err
+		}
+	}
+	return doc, 0, nil
+}
+
+// errTestFailed is returned by a test operation whose value does not match.
+var errTestFailed = errors.New("test failed")
+
+func applyPatchOperation(doc any, op patchOperation) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("missing value for %s", op.Op)
+		}
+		value, err = decodeOrderedJSON(op.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value: %w", err)
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" && strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, errors.New("can not move a value into one of its children")
+		}
+		value, err = pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			doc, err = pointerRemove(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value = copyJSON(value)
+		}
+	}
+	switch op.Op {
+	case "add", "move", "copy":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		return pointerRemove(doc, path)
+	case "replace":
+		_, err = pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerReplace(doc, path, value)
+	case "test":
+		actual, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equalJSON(actual, value) {
+			return nil, errTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("invalid operation: %q", op.Op)
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer: %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses token as an index into an array of length n. If end is
+// set, n itself (or "-") is a valid index too.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index: %q", token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("array index out of range: %d", i)
+	}
+	return i, nil
+}
+
+// pointerGet returns the value at path in doc.
+func pointerGet(doc any, path []string) (any, error) {
+	for _, token := range path {
+		switch v := doc.(type) {
+		case *jsonObject:
+			child, ok := v.values[token]
+			if !ok {
+				return nil, fmt.Errorf("no such member: %q", token)
+			}
+			doc = child
+		case []any:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("can not get %q of a scalar", token)
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate replaces the parent container of the value at path in doc by
+// the result of fn and returns the resulting document. path must not be
+// empty.
+func pointerUpdate(doc any, path []string, fn func(container any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := pointerGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = pointerUpdate(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	switch v := doc.(type) {
+	case *jsonObject:
+		v.set(path[0], child)
+	case []any:
+		i, _ := arrayIndex(path[0], len(v), false)
+		v[i] = child
+	}
+	return doc, nil
+}
+
+// pointerAdd adds value at path to doc, inserting it into arrays.
+func pointerAdd(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, path, func(container any, token string) (any, error) {
+		switch v := container.(type) {
+		case *jsonObject:
+			v.set(token, value)
+			return v, nil
+		case []any:
+			i, err := arrayIndex(token, len(v), true)
+			if err != nil {
+				return nil, err
+			}
+			v = append(v, nil)
+			copy(v[i+1:], v[i:])
+			v[i] = value
+			return v, nil
+		default:
+			return nil, fmt.Errorf("can not add %q to a scalar", token)
+		}
+	})
+}
+
+// pointerReplace replaces the existing value at path in doc by value, keeping
+// its position in objects.
+func pointerReplace(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, path, func(container any, token string) (any, error) {
+		switch v := container.(type) {
+		case *jsonObject:
+			v.set(token, value)
+			return v, nil
+		case []any:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = value
+			return v, nil
+		default:
+			return nil, fmt.Errorf("can not replace %q of a scalar", token)
+		}
+	})
+}
+
+// pointerRemove removes the value at path from doc.
+func pointerRemove(doc any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, errors.New("can not remove the root")
+	}
+	return pointerUpdate(doc, path, func(container any, token string) (any, error) {
+		switch v := container.(type) {
+		case *jsonObject:
+			if !v.remove(token) {
+				return nil, fmt.Errorf("no such member: %q", token)
+			}
+			return v, nil
+		case []any:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(v[:i], v[i+1:]...), nil
+		default:
+			return nil, fmt.Errorf("can not remove %q from a scalar", token)
+		}
+	})
+}
+
+// copyJSON returns a deep copy of a decoded JSON value.
+func copyJSON(v any) any {
+	switch v := v.(type) {
+	case *jsonObject:
+		c := newJSONObject()
+		for _, key := range v.keys {
+			c.set(key, copyJSON(v.values[key]))
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, value := range v {
+			c[i] = copyJSON(value)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// equalJSON reports whether two decoded JSON values are equal, numbers are
+// compared by their value and the order of object members is ignored.
+func equalJSON(a, b any) bool {
+	switch a := a.(type) {
+	case *jsonObject:
+		b, ok := b.(*jsonObject)
+		if !ok {
+			return false
+		}
+		return equalJSON(a.values, b.values)
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equalJSON(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalJSON(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,623 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tionis/ssh-data/util"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSON documents written to keys matching the pattern list of a registered
+// schema are validated against it before the transaction is committed. The
+// validator supports the following subset of JSON Schema: type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// uniqueItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, multipleOf, minProperties,
+// maxProperties, allOf, anyOf, oneOf and not. Other keywords are ignored.
+
+// jsonSchema is a compiled JSON schema.
+type jsonSchema struct {
+	// always is set for the boolean schemas true and false.
+	always *bool
+
+	types    []string
+	enum     []any
+	hasConst bool
+	constant any
+
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	minProperties        *int
+	maxProperties        *int
+
+	items       *jsonSchema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*jsonSchema
+	anyOf []*jsonSchema
+	oneOf []*jsonSchema
+	not   *jsonSchema
+}
+
+// schemaViolation describes why a value does not match a schema.
+type schemaViolation struct {
+	// Path is the JSON Pointer of the value.
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+var jsonSchemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// compileSchema compiles a decoded JSON schema.
+func compileSchema(v any) (*jsonSchema, error) {
+	if b, ok := v.(bool); ok {
+		return &jsonSchema{always: &b}, nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("schema must be an object or a boolean")
+	}
+	s := &jsonSchema{}
+	var err error
+	for keyword, value := range m {
+		switch keyword {
+		case "type":
+			switch value := value.(type) {
+			case string:
+				s.types = []string{value}
+			case []any:
+				for _, typ := range value {
+					typ, ok := typ.(string)
+					if !ok {
+						return nil, errors.New("type must be a string or an array of strings")
+					}
+					s.types = append(s.types, typ)
+				}
+			default:
+				return nil, errors.New("type must be a string or an array of strings")
+			}
+			for _, typ := range s.types {
+				if !jsonSchemaTypes[typ] {
+					return nil, fmt.Errorf("invalid type: %s", typ)
+				}
+			}
+		case "enum":
+			enum, ok := value.([]any)
+			if !ok {
+				return nil, errors.New("enum must be an array")
+			}
+			s.enum = enum
+		case "const":
+			s.hasConst, s.constant = true, value
+		case "properties":
+			properties, ok := value.(map[string]any)
+			if !ok {
+				return nil, errors.New("properties must be an object")
+			}
+			s.properties = make(map[string]*jsonSchema, len(properties))
+			for name, property := range properties {
+				s.properties[name], err = compileSchema(property)
+				if err != nil {
+					return nil, fmt.Errorf("invalid schema of property %s: %w", name, err)
+				}
+			}
+		case "required":
+			required, ok := value.([]any)
+			if !ok {
+				return nil, errors.New("required must be an array of strings")
+			}
+			for _, name := range required {
+				name, ok := name.(string)
+				if !ok {
+					return nil, errors.New("required must be an array of strings")
+				}
+				s.required = append(s.required, name)
+			}
+		case "additionalProperties", "items", "not":
+			sub, err := compileSchema(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid schema in %s: %w", keyword, err)
+			}
+			switch keyword {
+			case "additionalProperties":
+				s.additionalProperties = sub
+			case "items":
+				s.items = sub
+			default:
+				s.not = sub
+			}
+		case "allOf", "anyOf", "oneOf":
+			list, ok := value.([]any)
+			if !ok || len(list) == 0 {
+				return nil, fmt.Errorf("%s must be a non-empty array of schemas", keyword)
+			}
+			schemas := make([]*jsonSchema, len(list))
+			for i, sub := range list {
+				schemas[i], err = compileSchema(sub)
+				if err != nil {
+					return nil, fmt.Errorf("invalid schema in %s: %w", keyword, err)
+				}
+			}
+			switch keyword {
+			case "allOf":
+				s.allOf = schemas
+			case "anyOf":
+				s.anyOf = schemas
+			default:
+				s.oneOf = schemas
+			}
+		case "minItems", "maxItems", "minLength", "maxLength", "minProperties", "maxProperties":
+			n, ok := schemaNumber(value)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return nil, fmt.Errorf("%s must be a non-negative integer", keyword)
+			}
+			i := int(n)
+			switch keyword {
+			case "minItems":
+				s.minItems = &i
+			case "maxItems":
+				s.maxItems = &i
+			case "minLength":
+				s.minLength = &i
+			case "maxLength":
+				s.maxLength = &i
+			case "minProperties":
+				s.minProperties = &i
+			default:
+				s.maxProperties = &i
+			}
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf":
+			n, ok := schemaNumber(value)
+			if !ok || (keyword == "multipleOf" && n <= 0) {
+				return nil, fmt.Errorf("invalid %s", keyword)
+			}
+			switch keyword {
+			case "minimum":
+				s.minimum = &n
+			case "maximum":
+				s.maximum = &n
+			case "exclusiveMinimum":
+				s.exclusiveMinimum = &n
+			case "exclusiveMaximum":
+				s.exclusiveMaximum = &n
+			default:
+				s.multipleOf = &n
+			}
+		case "uniqueItems":
+			unique, ok := value.(bool)
+			if !ok {
+				return nil, errors.New("uniqueItems must be a boolean")
+			}
+			s.uniqueItems = unique
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return nil, errors.New("pattern must be a string")
+			}
+			s.pattern, err = regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern: %w", err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// schemaNumber returns a decoded JSON number as float64.
+func schemaNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// schemaType returns the JSON Schema type of a decoded JSON value. Numbers
+// without a fractional part are integers.
+func schemaType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	default:
+		if n, ok := schemaNumber(v); ok && n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	}
+}
+
+// validate returns the violations of the schema by v, which is located at
+// path in the validated document.
+func (s *jsonSchema) validate(v any, path string) []schemaViolation {
+	if s.always != nil {
+		if *s.always {
+			return nil
+		}
+		return []schemaViolation{{path, "no value is allowed"}}
+	}
+	var violations []schemaViolation
+	fail := func(format string, args ...any) {
+		violations = append(violations, schemaViolation{path, fmt.Sprintf(format, args...)})
+	}
+	typ := schemaType(v)
+	if s.types != nil {
+		ok := false
+		for _, allowed := range s.types {
+			if allowed == typ || (allowed == "number" && typ == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("expected %s, got %s", strings.Join(s.types, " or "), typ)
+			return violations
+		}
+	}
+	if s.enum != nil {
+		ok := false
+		for _, allowed := range s.enum {
+			if equalJSON(v, allowed) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !equalJSON(v, s.constant) {
+		fail("value does not match the constant")
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %s", name)
+			}
+		}
+		if s.minProperties != nil && len(v) < *s.minProperties {
+			fail("expected at least %d properties", *s.minProperties)
+		}
+		if s.maxProperties != nil && len(v) > *s.maxProperties {
+			fail("expected at most %d properties", *s.maxProperties)
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := v[name]
+			sub, ok := s.properties[name]
+			if !ok {
+				sub = s.additionalProperties
+			}
+			if sub == nil {
+				continue
+			}
+			childPath := path + "/" + strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+			if !ok && sub.always != nil && !*sub.always {
+				violations = append(violations, schemaViolation{childPath, "additional property is not allowed"})
+				continue
+			}
+			violations = append(violations, sub.validate(value, childPath)...)
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			fail("expected at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			fail("expected at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems {
+		unique:
+			for i := range v {
+				for j := 0; j < i; j++ {
+					if equalJSON(v[i], v[j]) {
+						fail("items %d and %d are equal", j, i)
+						break unique
+					}
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range v {
+				violations = append(violations, s.items.validate(item, path+"/"+strconv.Itoa(i))...)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			fail("expected at least %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("expected at most %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("value does not match pattern %s", s.pattern)
+		}
+	default:
+		if n, ok := schemaNumber(v); ok {
+			if s.minimum != nil && n < *s.minimum {
+				fail("expected at least %v", *s.minimum)
+			}
+			if s.maximum != nil && n > *s.maximum {
+				fail("expected at most %v", *s.maximum)
+			}
+			if s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum {
+				fail("expected more than %v", *s.exclusiveMinimum)
+			}
+			if s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum {
+				fail("expected less than %v", *s.exclusiveMaximum)
+			}
+			if s.multipleOf != nil {
+				q := n / *s.multipleOf
+				if math.Abs(q-math.Round(q)) > 1e-9 {
+					fail("expected a multiple of %v", *s.multipleOf)
+				}
+			}
+		}
+	}
+	for _, sub := range s.allOf {
+		violations = append(violations, sub.validate(v, path)...)
+	}
+	if s.anyOf != nil {
+		ok := false
+		for _, sub := range s.anyOf {
+			if len(sub.validate(v, path)) == 0 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			fail("value does not match any schema of anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		matches := 0
+		for _, sub := range s.oneOf {
+			if len(sub.validate(v, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("value matches %d schemas of oneOf instead of exactly one", matches)
+		}
+	}
+	if s.not != nil && len(s.not.validate(v, path)) == 0 {
+		fail("value must not match the schema of not")
+	}
+	return violations
+}
+
+// boundSchema is a schema registered for the keys matching a pattern list.
+type boundSchema struct {
+	pattern  string
+	patterns []*util.Pattern
+	schema   *jsonSchema
+}
+
+// loadSchemas returns the registered schemas, they are loaded once per
+// transaction.
+func (t *txn) loadSchemas() ([]boundSchema, error) {
+	if t.schemas != nil {
+		return *t.schemas, nil
+	}
+	rows, err := t.query("SELECT pattern, schema FROM json_schemas ORDER BY pattern;")
+	if err != nil {
+		return nil, fmt.Errorf("could not load schemas: %w", err)
+	}
+	defer rows.Close()
+	schemas := []boundSchema{}
+	for rows.Next() {
+		var pattern, schema string
+		err = rows.Scan(&pattern, &schema)
+		if err != nil {
+			return nil, fmt.Errorf("could not load schemas: %w", err)
+		}
+		bound, err := newBoundSchema(pattern, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema for %s: %w", pattern, err)
+		}
+		schemas = append(schemas, bound)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not load schemas: %w", err)
+	}
+	t.schemas = &schemas
+	return schemas, nil
+}
+
+func newBoundSchema(pattern, schema string) (boundSchema, error) {
+	patterns, err := util.ParsePatternList(pattern)
+	if err != nil {
+		return boundSchema{}, err
+	}
+	decoded, err := decodeJSON([]byte(schema))
+	if err != nil {
+		return boundSchema{}, errInvalidJSON
+	}
+	compiled, err := compileSchema(decoded)
+	if err != nil {
+		return boundSchema{}, err
+	}
+	return boundSchema{pattern: pattern, patterns: patterns, schema: compiled}, nil
+}
+
+// validateJSON validates the JSON document in key against all schemas whose
+// pattern list matches key and returns a SCHEMA error listing the violations
+// of the first schema it does not match.
+func (t *txn) validateJSON(key string) error {
+	schemas, err := t.loadSchemas()
+	if err != nil || len(schemas) == 0 {
+		return err
+	}
+	var doc any
+	decoded := false
+	for _, bound := range schemas {
+		if !util.MatchPatternList(bound.patterns, key) {
+			continue
+		}
+		if !decoded {
+			value, _, err := t.getJSON(key, "$")
+			if err != nil {
+				return err
+			}
+			doc, err = decodeJSON(value)
+			if err != nil {
+				return fmt.Errorf("could not decode document: %w", err)
+			}
+			decoded = true
+		}
+		violations := bound.schema.validate(doc, "")
+		if len(violations) > 0 {
+			return &commandError{
+				code:    "SCHEMA",
+				message: fmt.Sprintf("document violates the schema for %s", bound.pattern),
+				data:    map[string]any{"schema": bound.pattern, "violations": violations},
+			}
+		}
+	}
+	return nil
+}
+
+// checkNoSchema returns a SCHEMA error if a schema is registered for key, so
+// keys with a schema can only hold JSON documents. It is called before values
+// of other types are written.
+func (t *txn) checkNoSchema(key string) error {
+	schemas, err := t.loadSchemas()
+	if err != nil {
+		return err
+	}
+	for _, bound := range schemas {
+		if util.MatchPatternList(bound.patterns, key) {
+			return &commandError{
+				code:    "SCHEMA",
+				message: fmt.Sprintf("only JSON documents can be stored in keys matching the schema for %s", bound.pattern),
+				data:    map[string]any{"schema": bound.pattern},
+			}
+		}
+	}
+	return nil
+}
+
+// cmdJSONSchema implements JSON.SCHEMA SET patterns schema, JSON.SCHEMA GET
+// patterns, JSON.SCHEMA DEL patterns and JSON.SCHEMA LIST. Schemas are bound
+// to comma-separated pattern lists, documents that are already stored are not
+// validated when a schema is set.
+func cmdJSONSchema(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 3); err != nil {
+		return nil, err
+	}
+	subcommand, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	subcommand = strings.ToUpper(subcommand)
+	if subcommand == "LIST" {
+		if len(args) != 1 {
+			return nil, errWrongNumberOfArguments
+		}
+		schemas, err := t.loadSchemas()
+		if err != nil {
+			return nil, err
+		}
+		patterns := make([]any, len(schemas))
+		for i, bound := range schemas {
+			patterns[i] = bound.pattern
+		}
+		return patterns, nil
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumberOfArguments
+	}
+	pattern, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	switch subcommand {
+	case "SET":
+		if len(args) != 3 {
+			return nil, errWrongNumberOfArguments
+		}
+		schema, err := argJSON(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		_, err = newBoundSchema(pattern, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema: %w", err)
+		}
+		_, err = t.exec(`INSERT INTO json_schemas(pattern, schema) VALUES (?, json(?))
+			ON CONFLICT(pattern) DO UPDATE SET schema = excluded.schema;`, pattern, schema)
+		if err != nil {
+			return nil, fmt.Errorf("could not set schema: %w", err)
+		}
+		t.schemas = nil
+		return "OK", nil
+	case "GET":
+		if len(args) != 2 {
+			return nil, errWrongNumberOfArguments
+		}
+		var schema string
+		err = t.queryRow("SELECT schema FROM json_schemas WHERE pattern = ?;", pattern).Scan(&schema)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not get schema: %w", err)
+		}
+		return json.RawMessage(schema), nil
+	case "DEL":
+		if len(args) != 2 {
+			return nil, errWrongNumberOfArguments
+		}
+		res, err := t.exec("DELETE FROM json_schemas WHERE pattern = ?;", pattern)
+		if err != nil {
+			return nil, fmt.Errorf("could not delete schema: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("could not delete schema: %w", err)
+		}
+		t.schemas = nil
+		return n, nil
+	default:
+		return nil, fmt.Errorf("invalid subcommand: %s", subcommand)
+	}
+}
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The elements of a list are stored in the lists table ordered by their
+// position. Pushing to the left uses the position before the first element and
+// pushing to the right the one after the last, so both ends are updated with
+// an index lookup and positions are never renumbered. Like hashes, lists are
+// deleted with their last element.
+
+var errIndexOutOfRange = errors.New("index out of range")
+
+// listEnd parses LEFT or RIGHT and returns true for LEFT.
+func listEnd(s string) (bool, error) {
+	switch strings.ToUpper(s) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expected LEFT or RIGHT: %s", s)
+	}
+}
+
+// listLen returns the number of elements of a list, 0 if it does not exist.
+func (t *txn) listLen(key string) (int64, error) {
+	ok, err := t.checkType(key, typeList)
+	if err != nil || !ok {
+		return 0, err
+	}
+	var n int64
+	err = t.queryRow("SELECT count(*) FROM lists WHERE key = ?;", key).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("could not count elements: %w", err)
+	}
+	return n, nil
+}
+
+// listPush pushes values one after another to the left or right end of a
+// list, creating it if necessary, and returns its new length.
+func (t *txn) listPush(key string, values []string, left bool) (int64, error) {
+	err := t.createKey(key, typeList)
+	if err != nil {
+		return 0, err
+	}
+	var first, last int64
+	err = t.queryRow("SELECT coalesce(min(position), 1), coalesce(max(position), 0) FROM lists WHERE key = ?;",
+		key).Scan(&first, &last)
+	if err != nil {
+		return 0, fmt.Errorf("could not push elements: %w", err)
+	}
+	for _, value := range values {
+		position := last + 1
+		if left {
+			position = first - 1
+			first = position
+		} else {
+			last = position
+		}
+		_, err = t.exec("INSERT INTO lists(key, position, value) VALUES (?, ?, ?);", key, position, value)
+		if err != nil {
+			return 0, fmt.Errorf("could not push elements: %w", err)
+		}
+	}
+	event := "rpush"
+	if left {
+		event = "lpush"
+	}
+	err = t.modified(key, event)
+	if err != nil {
+		return 0, err
+	}
+	return t.listLen(key)
+}
+
+// listPop removes up to count elements from the left or right end of a list
+// and returns them, nil if the list does not exist.
+func (t *txn) listPop(key string, left bool, count int64) ([]string, error) {
+	ok, err := t.checkType(key, typeList)
+	if err != nil || !ok {
+		return nil, err
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return nil, err
+	}
+	order, op, event := "DESC", ">=", "rpop"
+	if left {
+		order, op, event = "ASC", "<=", "lpop"
+	}
+	rows, err := t.query("SELECT position, value FROM lists WHERE key = ? ORDER BY position "+order+" LIMIT ?;",
+		key, count)
+	if err != nil {
+		return nil, fmt.Errorf("could not pop elements: %w", err)
+	}
+	defer rows.Close()
+	values := []string{}
+	var last int64
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&last, &value)
+		if err != nil {
+			return nil, fmt.Errorf("could not pop elements: %w", err)
+		}
+		values = append(values, value)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not pop elements: %w", err)
+	}
+	if len(values) == 0 {
+		return values, nil
+	}
+	_, err = t.exec("DELETE FROM lists WHERE key = ? AND position "+op+" ?;", key, last)
+	if err != nil {
+		return nil, fmt.Errorf("could not pop elements: %w", err)
+	}
+	err = t.modified(key, event)
+	if err != nil {
+		return nil, err
+	}
+	return values, t.deleteIfEmpty(key, "lists")
+}
+
+// listMove pops an element from one end of src and pushes it to one end of
+// dst. It returns the element and whether src existed.
+func (t *txn) listMove(src, dst string, fromLeft, toLeft bool) (string, bool, error) {
+	_, err := t.checkType(dst, typeList)
+	if err != nil {
+		return "", false, err
+	}
+	values, err := t.listPop(src, fromLeft, 1)
+	if err != nil || values == nil {
+		return "", false, err
+	}
+	_, err = t.listPush(dst, values, toLeft)
+	if err != nil {
+		return "", false, err
+	}
+	return values[0], true, nil
+}
+
+// listPosition returns the position of the element at index, negative indexes
+// count from the end. ok is false if the index is out of range.
+func (t *txn) listPosition(key string, index int64) (position int64, ok bool, err error) {
+	order := "ASC"
+	if index < 0 {
+		order = "DESC"
+		index = -index - 1
+	}
+	err = t.queryRow("SELECT position FROM lists WHERE key = ? ORDER BY position "+order+" LIMIT 1 OFFSET ?;",
+		key, index).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("could not get element: %w", err)
+	}
+	return position, true, nil
+}
+
+// listRange converts start and stop, which may be negative to count from the
+// end, into offsets into a list of length n. It returns false if the range is
+// empty.
+func listRange(start, stop, n int64) (int64, int64, bool) {
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	return start, stop, start <= stop
+}
+
+// pushCommand returns the implementation of LPUSH and RPUSH key value...,
+// which return the new length of the list.
+func pushCommand(left bool) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		if err := checkArgs(args, 2, -1); err != nil {
+			return nil, err
+		}
+		strs, err := argStrings(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return t.listPush(strs[0], strs[1:], left)
+	}
+}
+
+// popCommand returns the implementation of LPOP and RPOP key [count]. Without
+// count they return a single element, with it a list of up to count elements;
+// nil if the list does not exist.
+func popCommand(left bool) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		if err := checkArgs(args, 1, 2); err != nil {
+			return nil, err
+		}
+		key, err := argString(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		count := int64(1)
+		if len(args) == 2 {
+			count, err = argInt(args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if count < 0 {
+				return nil, errors.New("count must not be negative")
+			}
+		}
+		values, err := t.listPop(key, left, count)
+		if err != nil || values == nil {
+			return nil, err
+		}
+		if len(args) == 1 {
+			return values[0], nil
+		}
+		result := make([]any, len(values))
+		for i, value := range values {
+			result[i] = value
+		}
+		return result, nil
+	}
+}
+
+// cmdLLen implements LLEN key.
+func cmdLLen(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return t.listLen(key)
+}
+
+// cmdLRange implements LRANGE key start stop, which returns the elements from
+// start to stop (both inclusive).
+func cmdLRange(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	start, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	stop, err := argInt(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	n, err := t.listLen(key)
+	if err != nil {
+		return nil, err
+	}
+	result := []any{}
+	start, stop, ok := listRange(start, stop, n)
+	if !ok {
+		return result, nil
+	}
+	rows, err := t.query("SELECT value FROM lists WHERE key = ? ORDER BY position LIMIT ? OFFSET ?;",
+		key, stop-start+1, start)
+	if err != nil {
+		return nil, fmt.Errorf("could not get elements: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, fmt.Errorf("could not get elements: %w", err)
+		}
+		result = append(result, value)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not get elements: %w", err)
+	}
+	return result, nil
+}
+
+// cmdLTrim implements LTRIM key start stop, which removes all elements outside
+// of the range from start to stop.
+func cmdLTrim(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	start, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	stop, err := argInt(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	n, err := t.listLen(key)
+	if err != nil || n == 0 {
+		return "OK", err
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return nil, err
+	}
+	start, stop, ok := listRange(start, stop, n)
+	if !ok {
+		_, err = t.del(key)
+		return "OK", err
+	}
+	if start == 0 && stop == n-1 {
+		return "OK", nil
+	}
+	first, _, err := t.listPosition(key, start)
+	if err != nil {
+		return nil, err
+	}
+	last, _, err := t.listPosition(key, stop)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.exec("DELETE FROM lists WHERE key = ? AND (position < ? OR position > ?);", key, first, last)
+	if err != nil {
+		return nil, fmt.Errorf("could not trim list: %w", err)
+	}
+	return "OK", t.modified(key, "ltrim")
+}
+
+// cmdLIndex implements LINDEX key index and returns nil if the index is out of
+// range.
+func cmdLIndex(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	index, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := t.checkType(key, typeList)
+	if err != nil || !ok {
+		return nil, err
+	}
+	position, ok, err := t.listPosition(key, index)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var value string
+	err = t.queryRow("SELECT value FROM lists WHERE key = ? AND position = ?;", key, position).Scan(&value)
+	if err != nil {
+		return nil, fmt.Errorf("could not get element: %w", err)
+	}
+	return value, nil
+}
+
+// cmdLSet implements LSET key index value.
+func cmdLSet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	index, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	value, err := argString(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := t.checkType(key, typeList)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errNoSuchKey
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return nil, err
+	}
+	position, ok, err := t.listPosition(key, index)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errIndexOutOfRange
+	}
+	_, err = t.exec("UPDATE lists SET value = ? WHERE key = ? AND position = ?;", value, key, position)
+	if err != nil {
+		return nil, fmt.Errorf("could not set element: %w", err)
+	}
+	return "OK", t.modified(key, "lset")
+}
+
+// cmdLMove implements LMOVE source destination LEFT|RIGHT LEFT|RIGHT, which
+// moves an element from one end of source to one end of destination and
+// returns it, nil if source does not exist.
+func cmdLMove(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 4, 4); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	fromLeft, err := listEnd(strs[2])
+	if err != nil {
+		return nil, err
+	}
+	toLeft, err := listEnd(strs[3])
+	if err != nil {
+		return nil, err
+	}
+	value, ok, err := t.listMove(strs[0], strs[1], fromLeft, toLeft)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return value, nil
+}
+
+// cmdRPopLPush implements RPOPLPUSH source destination, which is LMOVE source
+// destination RIGHT LEFT.
+func cmdRPopLPush(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	return cmdLMove(t, append(args[:2:2], "RIGHT", "LEFT"))
+}
+
+// blockingPopCommand returns the implementation of BLPOP and BRPOP key...
+// timeout, which pop an element from the first non-empty list and return the
+// key and the element. If all lists are empty, they wait for an element to be
+// pushed and return nil once the timeout expired.
+func blockingPopCommand(left bool) commandFunc {
+	return func(s *session, args []any) (any, error) {
+		if err := checkArgs(args, 2, -1); err != nil {
+			return nil, err
+		}
+		keys, err := argStrings(args[:len(args)-1], 0)
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := argTimeout(args, len(args)-1)
+		if err != nil {
+			return nil, err
+		}
+		return s.block(timeout, func(t *txn, _ []any) (any, error) {
+			for _, key := range keys {
+				values, err := t.listPop(key, left, 1)
+				if err != nil {
+					return nil, err
+				}
+				if values != nil {
+					return []any{key, values[0]}, nil
+				}
+			}
+			return nil, nil
+		}, nil)
+	}
+}
+
+// cmdBLMove implements BLMOVE source destination LEFT|RIGHT LEFT|RIGHT
+// timeout, the blocking variant of LMOVE.
+func cmdBLMove(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 5, 5); err != nil {
+		return nil, err
+	}
+	timeout, err := argTimeout(args, 4)
+	if err != nil {
+		return nil, err
+	}
+	return s.block(timeout, cmdLMove, args[:4])
+}
+
+// cmdBRPopLPush implements BRPOPLPUSH source destination timeout, the blocking
+// variant of RPOPLPUSH.
+func cmdBRPopLPush(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	timeout, err := argTimeout(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	return s.block(timeout, cmdRPopLPush, args[:2])
+}
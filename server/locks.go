@@ -0,0 +1,211 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Locks are leases on key names that allow clients to do read-modify-write
+// cycles on values they can only manipulate client side (e.g. encrypted data).
+// Every lease gets a fencing token from a database-wide counter. While a lease
+// is active, writes to its key are only accepted if they are wrapped in
+// FENCE with the token of the lease, so a client whose lease expired (or was
+// taken over) cannot overwrite changes of the next holder. Expired leases can
+// be taken over by LOCK and are purged by the reaper.
+
+var (
+	errLocked = &commandError{code: "LOCKED", message: "key is locked by another client"}
+	errFenced = &commandError{code: "FENCED", message: "fencing token is stale or its lease has expired"}
+)
+
+// nextCounter increments the database-wide counter name and returns its new
+// value.
+func (t *txn) nextCounter(name string) (int64, error) {
+	var value int64
+	err := t.queryRow(`INSERT INTO counters(name, value) VALUES (?, 1)
+		ON CONFLICT(name) DO UPDATE SET value = value + 1 RETURNING value;`, name).Scan(&value)
+	if err != nil {
+		return 0, fmt.Errorf("could not increment counter %s: %w", name, err)
+	}
+	return value, nil
+}
+
+// lease returns the token of the active lease on key or 0 if there is none.
+func (t *txn) lease(key string) (int64, error) {
+	var token int64
+	err := t.queryRow("SELECT token FROM locks WHERE key = ? AND lockedUntil > ?;", key, t.now).Scan(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not get lock: %w", err)
+	}
+	return token, nil
+}
+
+// checkLock returns an error unless the transaction may write to key: keys
+// with an active lease may only be written with the fencing token of the lease,
+// fenced writes are only accepted while their lease is active.
+func (t *txn) checkLock(key string) error {
+	token, err := t.lease(key)
+	if err != nil {
+		return err
+	}
+	if t.fence == 0 {
+		if token != 0 {
+			return errLocked
+		}
+		return nil
+	}
+	if token != t.fence {
+		return errFenced
+	}
+	return nil
+}
+
+// cmdLock implements LOCK key milliseconds. It returns the fencing token of the
+// new lease or nil if the key is locked by someone else.
+func cmdLock(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, errors.New("invalid lock timeout")
+	}
+	current, err := t.lease(key)
+	if err != nil {
+		return nil, err
+	}
+	if current != 0 {
+		return nil, nil
+	}
+	token, err := t.nextCounter("fencing")
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.exec(`INSERT INTO locks(key, token, lockedUntil) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET token = excluded.token, lockedUntil = excluded.lockedUntil;`,
+		key, token, t.now+ttl)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock key: %w", err)
+	}
+	return token, nil
+}
+
+// cmdRenew implements RENEW key token milliseconds, which extends an active
+// lease.
+func cmdRenew(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	token, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := argInt(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, errors.New("invalid lock timeout")
+	}
+	current, err := t.lease(key)
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 || current != token {
+		return nil, errFenced
+	}
+	_, err = t.exec("UPDATE locks SET lockedUntil = ? WHERE key = ?;", t.now+ttl, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not renew lock: %w", err)
+	}
+	return "OK", nil
+}
+
+// cmdUnlock implements UNLOCK key token. It returns 1 if the lease was released
+// and 0 if it had already expired.
+func cmdUnlock(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	token, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	current, err := t.lease(key)
+	if err != nil {
+		return nil, err
+	}
+	if current != 0 && current != token {
+		return nil, errFenced
+	}
+	_, err = t.exec("DELETE FROM locks WHERE key = ? AND token = ?;", key, token)
+	if err != nil {
+		return nil, fmt.Errorf("could not unlock key: %w", err)
+	}
+	if current == 0 {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// cmdFence implements FENCE token command [args...], which executes a data
+// command with a fencing token so it may write to keys locked with it.
+func cmdFence(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, -1); err != nil {
+		return nil, err
+	}
+	token, err := argInt(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if token <= 0 {
+		return nil, errors.New("invalid fencing token")
+	}
+	name, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.ToLower(name)
+	command, ok := dataCommands[name]
+	if !ok || name == "fence" {
+		return nil, fmt.Errorf("invalid command: %s", name)
+	}
+	fence := t.fence
+	t.fence = token
+	defer func() {
+		t.fence = fence
+	}()
+	return command(t, args[2:])
+}
+
+// reapLocks deletes up to reapBatchSize expired leases.
+func (db *UserDB) reapLocks() error {
+	return db.update(db.ctx, func(t *txn) error {
+		_, err := t.exec(`DELETE FROM locks WHERE key IN (
+			SELECT key FROM locks WHERE lockedUntil <= ? LIMIT ?);`, t.now, reapBatchSize)
+		if err != nil {
+			return fmt.Errorf("could not purge expired locks: %w", err)
+		}
+		return nil
+	})
+}
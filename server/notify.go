@@ -0,0 +1,137 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Keyspace notifications are published on the channels __keyspace__:<key>
+// (with the event as message) and __keyevent__:<event> (with the key as
+// message) when the notify-keyspace-events setting contains K and E
+// respectively. Events are published once the transaction that caused them
+// is committed, they are dropped if it is rolled back.
+
+const (
+	keyspaceChannelPrefix = "__keyspace__:"
+	keyeventChannelPrefix = "__keyevent__:"
+)
+
+// configParams maps the names of the settings of CONFIG to functions that
+// validate and normalize their values.
+var configParams = map[string]func(value string) (string, error){
+	"notify-keyspace-events": func(value string) (string, error) {
+		// the text protocol can not send an empty value
+		if strings.EqualFold(value, "none") || strings.EqualFold(value, "off") {
+			return "", nil
+		}
+		var flags string
+		for _, flag := range "KE" {
+			if strings.ContainsRune(strings.ToUpper(value), flag) {
+				flags += string(flag)
+			}
+		}
+		if len(flags) != len(value) {
+			return "", fmt.Errorf("invalid notify-keyspace-events: %s", value)
+		}
+		return flags, nil
+	},
+}
+
+// config returns the value of a setting, "" if it is not set.
+func (t *txn) config(name string) (string, error) {
+	var value string
+	err := t.queryRow("SELECT value FROM config WHERE name = ?;", name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get config: %w", err)
+	}
+	return value, nil
+}
+
+// cmdConfig implements CONFIG GET name and CONFIG SET name value for the
+// database-wide settings in configParams.
+func cmdConfig(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 3); err != nil {
+		return nil, err
+	}
+	subcommand, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	name, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.ToLower(name)
+	normalize, ok := configParams[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown config parameter: %s", name)
+	}
+	switch strings.ToUpper(subcommand) {
+	case "GET":
+		if len(args) != 2 {
+			return nil, errWrongNumberOfArguments
+		}
+		return t.config(name)
+	case "SET":
+		if len(args) != 3 {
+			return nil, errWrongNumberOfArguments
+		}
+		value, err := argString(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		value, err = normalize(value)
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.exec(`INSERT INTO config(name, value) VALUES (?, ?)
+			ON CONFLICT(name) DO UPDATE SET value = excluded.value;`, name, value)
+		if err != nil {
+			return nil, fmt.Errorf("could not set config: %w", err)
+		}
+		t.notifyFlags = &value
+		return "OK", nil
+	default:
+		return nil, fmt.Errorf("invalid subcommand: %s", subcommand)
+	}
+}
+
+// publish publishes message on channel once the transaction is committed.
+// The message is stored for the relay within the transaction.
+func (t *txn) publish(channel, message string) error {
+	_, err := t.exec("INSERT INTO pubsub_messages(channel, message, origin, created) VALUES (?, ?, ?, ?);",
+		channel, message, t.db.origin, time.Now().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("could not store message: %w", err)
+	}
+	t.published = append(t.published, channelMessage{Channel: channel, Message: message})
+	return nil
+}
+
+// notify publishes a keyspace notification for event on key if notifications
+// are enabled.
+func (t *txn) notify(event, key string) error {
+	if t.notifyFlags == nil {
+		flags, err := t.config("notify-keyspace-events")
+		if err != nil {
+			return err
+		}
+		t.notifyFlags = &flags
+	}
+	if strings.Contains(*t.notifyFlags, "K") {
+		err := t.publish(keyspaceChannelPrefix+key, event)
+		if err != nil {
+			return err
+		}
+	}
+	if strings.Contains(*t.notifyFlags, "E") {
+		return t.publish(keyeventChannelPrefix+event, key)
+	}
+	return nil
+}
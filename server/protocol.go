@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anmitsu/go-shlex"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Protocol selects how a UserServer session reads commands and writes replies.
+type Protocol int
+
+const (
+	// ProtocolAuto picks ProtocolJSON if the first non-blank line of a session
+	// starts with '[' or '{' and ProtocolText otherwise.
+	ProtocolAuto Protocol = iota
+	// ProtocolJSON reads a JSON request per line and writes a JSON envelope
+	// per line.
+	ProtocolJSON
+	// ProtocolText reads shell-quoted lines and writes plain lines.
+	ProtocolText
+)
+
+// ParseProtocol parses the name of a protocol as used on the command line.
+func ParseProtocol(s string) (Protocol, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return ProtocolAuto, nil
+	case "json":
+		return ProtocolJSON, nil
+	case "text":
+		return ProtocolText, nil
+	default:
+		return ProtocolAuto, fmt.Errorf("invalid protocol: %s", s)
+	}
+}
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolJSON:
+		return "json"
+	case ProtocolText:
+		return "text"
+	default:
+		return "auto"
+	}
+}
+
+// detectProtocol returns the protocol a session should use based on its first
+// non-blank line.
+func detectProtocol(line []byte) Protocol {
+	if len(line) > 0 && (line[0] == '[' || line[0] == '{') {
+		return ProtocolJSON
+	}
+	return ProtocolText
+}
+
+// request is a decoded request line.
+type request struct {
+	// id correlates the request with its reply; it is nil if the client did
+	// not supply one.
+	id   any
+	args []any
+}
+
+// pushWords is implemented by push payloads that print as several words in
+// the text protocol.
+type pushWords interface {
+	words() []any
+}
+
+// codec translates between request lines and commands and between command
+// results and reply lines.
+type codec interface {
+	// decode parses a request line into a command and its arguments.
+	decode(line []byte) (request, error)
+	// writeResult writes a single reply line for a result.
+	writeResult(out io.Writer, id any, result any) error
+	// writeError writes a single reply line for a failed command.
+	writeError(out io.Writer, id any, err error) error
+	// writePush writes a single line for a message the client did not
+	// directly request, e.g. a message on a subscribed channel. The id is the
+	// one of the request that caused the push.
+	writePush(out io.Writer, id any, kind string, payload any) error
+}
+
+func newCodec(p Protocol) codec {
+	if p == ProtocolJSON {
+		return jsonCodec{}
+	}
+	return textCodec{}
+}
+
+// jsonCodec implements the bot-friendly protocol. Requests are either a bare
+// JSON array or an object of the form {"id": ..., "command": [...]}, replies
+// are envelopes of the form {"id": ..., "ok": true, "result": ...} or
+// {"id": ..., "ok": false, "error": "..."}. Pushes additionally carry the kind
+// of push in "push" and the id of the request that caused them.
+type jsonCodec struct{}
+
+type jsonRequest struct {
+	ID      any   `json:"id"`
+	Command []any `json:"command"`
+}
+
+type resultEnvelope struct {
+	ID     any    `json:"id"`
+	OK     bool   `json:"ok"`
+	Push   string `json:"push,omitempty"`
+	Result any    `json:"result"`
+}
+
+type errorEnvelope struct {
+	ID    any    `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+	Data  any    `json:"data,omitempty"`
+}
+
+func (jsonCodec) decode(line []byte) (request, error) {
+	if len(line) > 0 && line[0] == '{' {
+		var req jsonRequest
+		err := json.Unmarshal(line, &req)
+		if err != nil {
+			return request{}, fmt.Errorf("could not unmarshal request: %w", err)
+		}
+		return request{id: req.ID, args: req.Command}, nil
+	}
+	var commandList []any
+	err := json.Unmarshal(line, &commandList)
+	if err != nil {
+		return request{}, fmt.Errorf("could not unmarshal command: %w", err)
+	}
+	return request{args: commandList}, nil
+}
+
+func (jsonCodec) writeResult(out io.Writer, id any, result any) error {
+	return writeJSONLine(out, resultEnvelope{ID: id, OK: true, Result: result})
+}
+
+func (jsonCodec) writeError(out io.Writer, id any, err error) error {
+	envelope := errorEnvelope{ID: id, Error: err.Error()}
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		envelope.Code = cmdErr.code
+		envelope.Data = cmdErr.data
+	}
+	return writeJSONLine(out, envelope)
+}
+
+func (jsonCodec) writePush(out io.Writer, id any, kind string, payload any) error {
+	return writeJSONLine(out, resultEnvelope{ID: id, OK: true, Push: kind, Result: payload})
+}
+
+func writeJSONLine(out io.Writer, v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not marshal reply: %w", err)
+	}
+	_, err = out.Write(append(line, '\n'))
+	return err
+}
+
+// textCodec implements the human-friendly protocol: requests are tokenized
+// like a shell command line and every reply is printed as exactly one line.
+// Scalars are printed as-is (or Go-quoted if they contain a line break), lists
+// are printed as shell-quoted words and everything else as compact JSON. Nil
+// and empty lists are printed as (nil) and (empty list), unquoted so they can
+// not be confused with strings, which are quoted if they look the same.
+// Pushes are printed as shell-quoted words starting with the kind of push.
+// Replies are written in request order, so the text protocol has no ids.
+type textCodec struct{}
+
+func (textCodec) decode(line []byte) (request, error) {
+	tokens, err := shlex.Split(string(line), true)
+	if err != nil {
+		return request{}, fmt.Errorf("could not tokenize command: %w", err)
+	}
+	commandList := make([]any, len(tokens))
+	for i, token := range tokens {
+		commandList[i] = token
+	}
+	return request{args: commandList}, nil
+}
+
+func (textCodec) writeResult(out io.Writer, _ any, result any) error {
+	var line string
+	if list, ok := result.([]any); ok && len(list) == 0 {
+		line = textEmptyList
+	} else if ok {
+		line = textWords(list)
+	} else if result == textNil || result == textEmptyList {
+		// strings that look like nil or an empty list are quoted
+		line = shellQuote(result.(string))
+	} else {
+		line = singleLine(textValue(result))
+	}
+	_, err := io.WriteString(out, line+"\n")
+	return err
+}
+
+func (textCodec) writePush(out io.Writer, _ any, kind string, payload any) error {
+	words := []any{kind}
+	if p, ok := payload.(pushWords); ok {
+		words = append(words, p.words()...)
+	} else {
+		words = append(words, payload)
+	}
+	_, err := io.WriteString(out, textWords(words)+"\n")
+	return err
+}
+
+func (textCodec) writeError(out io.Writer, _ any, err error) error {
+	message := strings.ReplaceAll(err.Error(), "\n", " ")
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) && cmdErr.data != nil {
+		message += " " + textValue(cmdErr.data)
+	}
+	_, err = io.WriteString(out, "ERR "+message+"\n")
+	return err
+}
+
+const (
+	textNil       = "(nil)"
+	textEmptyList = "(empty list)"
+)
+
+// textValue renders a single value for the text protocol.
+func textValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return textNil
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+}
+
+// textWords renders a list as a line of shell-quoted words.
+func textWords(list []any) string {
+	words := make([]string, len(list))
+	for i, v := range list {
+		if v == nil {
+			words[i] = textNil
+			continue
+		}
+		words[i] = shellQuote(singleLine(textValue(v)))
+	}
+	return strings.Join(words, " ")
+}
+
+// singleLine Go-quotes s if it would otherwise span several lines.
+func singleLine(s string) string {
+	if strings.ContainsAny(s, "\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// shellQuote quotes s so that it is read back as a single word by a POSIX
+// shell (and by the text protocol itself).
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, func(r rune) bool {
+		return !(r == '_' || r == '-' || r == '.' || r == '/' || r == ':' || r == '@' || r == ',' || r == '+' || r == '=' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
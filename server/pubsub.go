@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// channelMessage is the payload of a message pushed to a subscriber. Pattern
+// is only set for messages received through a pattern subscription.
+type channelMessage struct {
+	Pattern string `json:"pattern,omitempty"`
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+}
+
+func (m channelMessage) words() []any {
+	if m.Pattern != "" {
+		return []any{m.Pattern, m.Channel, m.Message}
+	}
+	return []any{m.Channel, m.Message}
+}
+
+// subscription is a channel subscription of a session whose messages are
+// pushed to the client by its own goroutine.
+type subscription struct {
+	sub    *subscriber
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// cmdPub implements PUB [--at/-a time] [--delay/-d duration] channel message
+// and returns the number of local subscribers that received the message. With
+// --at or --delay the message is scheduled and the command returns OK.
+func cmdPub(s *session, args []any) (any, error) {
+	flags, args, err := parseFlags(args, scheduleFlags...)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	channel, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	message, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	dueAt, err := parseDueAt(flags, now)
+	if err != nil {
+		return nil, err
+	}
+	if dueAt <= now {
+		return s.userDB.publish(channel, message)
+	}
+	err = s.userDB.update(s.ctx, func(t *txn) error {
+		return t.schedule("channel", channel, message, dueAt)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
+
+// cmdSub subscribes the session to one or more channels and returns the
+// number of subscriptions of the session. Messages are pushed with the id of
+// the sub request while the session keeps accepting commands.
+func cmdSub(s *session, args []any) (any, error) {
+	channels, size, policy, err := s.parseSubArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	s.subsMux.Lock()
+	defer s.subsMux.Unlock()
+	s.pruneSubs()
+	for _, channel := range channels {
+		if _, ok := s.subs[channel]; ok {
+			continue
+		}
+		s.subs[channel] = s.startSubscription(s.userDB.subscribe(channel, size, policy))
+	}
+	return len(s.subs) + len(s.psubs), nil
+}
+
+// cmdPSub subscribes the session to all channels matching one or more
+// comma-separated pattern lists (e.g. "sensors.*,!sensors.debug") and returns
+// the number of subscriptions of the session. Messages are pushed as pmessage
+// together with the pattern and the concrete channel.
+func cmdPSub(s *session, args []any) (any, error) {
+	patterns, size, policy, err := s.parseSubArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	s.subsMux.Lock()
+	defer s.subsMux.Unlock()
+	s.pruneSubs()
+	for _, pattern := range patterns {
+		if _, ok := s.psubs[pattern]; ok {
+			continue
+		}
+		sub, err := s.userDB.psubscribe(pattern, size, policy)
+		if err != nil {
+			return nil, err
+		}
+		s.psubs[pattern] = s.startSubscription(sub)
+	}
+	return len(s.subs) + len(s.psubs), nil
+}
+
+// parseSubArgs parses the arguments of sub and psub.
+func (s *session) parseSubArgs(args []any) ([]string, int, SlowConsumerPolicy, error) {
+	flags, args, err := parseFlags(args,
+		flagSpec{name: "buffer", short: "b", hasValue: true},
+		flagSpec{name: "policy", short: "p", hasValue: true},
+	)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, 0, 0, err
+	}
+	names, err := argStrings(args, 0)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	size := s.options.SubscriptionBuffer
+	if v, ok := flags["buffer"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, 0, 0, fmt.Errorf("invalid buffer size: %s", v)
+		}
+		size = n
+	}
+	policy := s.options.SlowConsumerPolicy
+	if v, ok := flags["policy"]; ok {
+		policy, err = ParseSlowConsumerPolicy(v)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return names, size, policy, nil
+}
+
+// startSubscription starts pushing the messages of sub to the client on
+// behalf of the current request.
+func (s *session) startSubscription(sub *subscriber) *subscription {
+	ctx, cancel := context.WithCancel(s.ctx)
+	subscription := &subscription{
+		sub:    sub,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go s.forward(ctx, subscription, s.requestID)
+	return subscription
+}
+
+// cmdUnsub removes the given subscriptions of the session, or all of them if
+// no channel is given, and returns the number of remaining subscriptions.
+func cmdUnsub(s *session, args []any) (any, error) {
+	return s.unsubscribe(s.subs, args)
+}
+
+// cmdPUnsub removes the given pattern subscriptions of the session, or all of
+// them if no pattern is given, and returns the number of remaining
+// subscriptions.
+func cmdPUnsub(s *session, args []any) (any, error) {
+	return s.unsubscribe(s.psubs, args)
+}
+
+func (s *session) unsubscribe(subs map[string]*subscription, args []any) (any, error) {
+	names, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.subsMux.Lock()
+	defer s.subsMux.Unlock()
+	if len(names) == 0 {
+		for name := range subs {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		sub, ok := subs[name]
+		if !ok {
+			continue
+		}
+		sub.cancel()
+		<-sub.done
+		delete(subs, name)
+	}
+	s.pruneSubs()
+	return len(s.subs) + len(s.psubs), nil
+}
+
+// cmdPubSub inspects the pubsub system:
+//
+//	pubsub channels           - channels with at least one subscriber
+//	pubsub numsub <channel>...- number of subscribers per channel
+//	pubsub numpat             - number of pattern subscribers
+//	pubsub stats              - counters of the database and this session
+func cmdPubSub(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	subcommand, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(subcommand) {
+	case "channels":
+		if err := checkArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		channels := s.userDB.pubsub.channels()
+		sort.Strings(channels)
+		result := make([]any, len(channels))
+		for i, channel := range channels {
+			result[i] = channel
+		}
+		return result, nil
+	case "numsub":
+		channels, err := argStrings(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]any, 0, 2*len(channels))
+		for _, channel := range channels {
+			result = append(result, channel, s.userDB.pubsub.numSub(channel))
+		}
+		return result, nil
+	case "numpat":
+		if err := checkArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		_, _, psubscribers, _, _ := s.userDB.pubsub.stats()
+		return psubscribers, nil
+	case "stats":
+		if err := checkArgs(args, 1, 1); err != nil {
+			return nil, err
+		}
+		channels, subscribers, psubscribers, published, dropped := s.userDB.pubsub.stats()
+		s.subsMux.Lock()
+		defer s.subsMux.Unlock()
+		subscriptions := append(subscriptionStats(s.subs, "channel"), subscriptionStats(s.psubs, "pattern")...)
+		return map[string]any{
+			"channels":      channels,
+			"subscribers":   subscribers,
+			"psubscribers":  psubscribers,
+			"published":     published,
+			"dropped":       dropped,
+			"subscriptions": subscriptions,
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid pubsub subcommand: %s", subcommand)
+	}
+}
+
+// subscriptionStats describes the state of subs sorted by name, the name is
+// stored under key.
+func subscriptionStats(subs map[string]*subscription, key string) []any {
+	names := make([]string, 0, len(subs))
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stats := make([]any, 0, len(subs))
+	for _, name := range names {
+		sub := subs[name]
+		queued, dropped, closed := sub.sub.status()
+		stats = append(stats, map[string]any{
+			key:       name,
+			"buffer":  sub.sub.size,
+			"policy":  sub.sub.policy.String(),
+			"queued":  queued,
+			"dropped": dropped,
+			"closed":  closed,
+		})
+	}
+	return stats
+}
+
+// pruneSubs forgets subscriptions that were closed by the broker,
+// s.subsMux must be held.
+func (s *session) pruneSubs() {
+	for _, subs := range []map[string]*subscription{s.subs, s.psubs} {
+		for name, sub := range subs {
+			select {
+			case <-sub.done:
+				sub.cancel()
+				delete(subs, name)
+			default:
+			}
+		}
+	}
+}
+
+// forward pushes the messages of a subscription to the client until ctx is
+// done or the broker closes the subscriber.
+func (s *session) forward(ctx context.Context, sub *subscription, id any) {
+	defer close(sub.done)
+	defer s.userDB.unsubscribe(sub.sub)
+	for {
+		msg, ok := sub.sub.next(ctx)
+		if !ok {
+			if ctx.Err() == nil {
+				_, dropped, _ := sub.sub.status()
+				name := sub.sub.channel
+				if sub.sub.patterns != nil {
+					name = sub.sub.pattern
+				}
+				s.logger.Warn("Disconnected slow subscriber", "subscription", name, "dropped", dropped)
+				err := s.writePush(id, "disconnected", name)
+				if err != nil {
+					s.logger.Error("Could not push message", "subscription", name, "error", err)
+				}
+			}
+			return
+		}
+		kind := "message"
+		if msg.Pattern != "" {
+			kind = "pmessage"
+		}
+		err := s.writePush(id, kind, msg)
+		if err != nil {
+			s.logger.Error("Could not push message", "channel", msg.Channel, "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entries appended to mpmc streams are queued in queue_messages instead of
+// being published, and every message is leased to one consumer at a time.
+// RECEIVE hides the messages it returns until their visibility timeout
+// expires, after which they are received again unless the consumer removed
+// them (on success), released them (to give up) or extended their lease. A
+// message is received with a receipt "id.deliveries", which stays valid until
+// the message is received again, so a consumer whose lease expired can not
+// remove or release a message that was leased to another one.
+
+const defaultVisibilityTimeout = 30 * time.Second
+
+var (
+	errQueueFull  = errors.New("stream is full")
+	errLeaseLost  = &commandError{code: "LEASELOST", message: "the message was removed or received again"}
+	errNotAQueue  = errors.New("stream is not an mpmc stream")
+	errBadReceipt = errors.New("invalid receipt")
+)
+
+// queueMessage is a message of an mpmc stream as returned by RECEIVE.
+type queueMessage struct {
+	ID      int64  `json:"id"`
+	Receipt string `json:"receipt"`
+	// Time is the time the message was appended in unix milliseconds.
+	Time     int64 `json:"time"`
+	Priority int64 `json:"priority"`
+	// Deliveries is the number of times the message was received, including
+	// this one.
+	Deliveries int64  `json:"deliveries"`
+	Data       string `json:"data"`
+}
+
+// enqueue appends a message to an mpmc stream that becomes visible at
+// visibleAt and returns its id.
+func (t *txn) enqueue(st *stream, data string, priority, visibleAt int64) (int64, error) {
+	if st.size > 0 {
+		var n int64
+		err := t.queryRow("SELECT count(*) FROM queue_messages WHERE stream = ?;", st.name).Scan(&n)
+		if err != nil {
+			return 0, fmt.Errorf("could not count messages: %w", err)
+		}
+		if n >= st.size {
+			return 0, errQueueFull
+		}
+	}
+	id := st.lastID + 1
+	_, err := t.exec("UPDATE streams SET lastID = ? WHERE name = ?;", id, st.name)
+	if err != nil {
+		return 0, fmt.Errorf("could not append message: %w", err)
+	}
+	st.lastID = id
+	_, err = t.exec(`INSERT INTO queue_messages(stream, id, priority, visibleAt, created, data)
+		VALUES (?, ?, ?, ?, ?, ?);`, st.name, id, priority, visibleAt, t.now, data)
+	if err != nil {
+		return 0, fmt.Errorf("could not append message: %w", err)
+	}
+	t.changed = true
+	return id, nil
+}
+
+// getQueue returns the settings of an mpmc stream.
+func (t *txn) getQueue(name string) (*stream, error) {
+	st, err := t.getStream(name)
+	if err != nil {
+		return nil, err
+	}
+	if !st.mpmc {
+		return nil, errNotAQueue
+	}
+	return st, nil
+}
+
+// receive leases up to count visible messages of an mpmc stream for
+// visibility milliseconds. It returns nil if there are none and the time at
+// which the next message becomes visible (0 if there are no messages).
+func (t *txn) receive(name string, count, visibility int64) (any, int64, error) {
+	_, err := t.getQueue(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := t.query(`SELECT id, created, priority, deliveries, data FROM queue_messages
+		WHERE stream = ? AND visibleAt <= ? ORDER BY priority DESC, id LIMIT ?;`, name, t.now, count)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not receive messages: %w", err)
+	}
+	var messages []queueMessage
+	for rows.Next() {
+		var m queueMessage
+		err = rows.Scan(&m.ID, &m.Time, &m.Priority, &m.Deliveries, &m.Data)
+		if err != nil {
+			rows.Close()
+			return nil, 0, fmt.Errorf("could not receive messages: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("could not receive messages: %w", err)
+	}
+	if messages == nil {
+		var next sql.NullInt64
+		err = t.queryRow("SELECT min(visibleAt) FROM queue_messages WHERE stream = ?;", name).Scan(&next)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not receive messages: %w", err)
+		}
+		return nil, next.Int64, nil
+	}
+	result := make([]any, len(messages))
+	for i, m := range messages {
+		m.Deliveries++
+		m.Receipt = strconv.FormatInt(m.ID, 10) + "." + strconv.FormatInt(m.Deliveries, 10)
+		_, err = t.exec("UPDATE queue_messages SET visibleAt = ?, deliveries = ? WHERE stream = ? AND id = ?;",
+			t.now+visibility, m.Deliveries, name, m.ID)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not receive messages: %w", err)
+		}
+		result[i] = m
+	}
+	return result, 0, nil
+}
+
+// cmdStreamsReceive implements STREAMS RECEIVE [--visibility/-v duration]
+// [--count/-c n] [--block/-b duration] name. It leases up to n (default 1)
+// messages of an mpmc stream for the visibility timeout (default 30s) and
+// returns them as list of objects with the id, receipt, time, priority,
+// number of deliveries and data of each message. With --block it waits up to
+// the duration (0 meaning forever) for messages if there are none yet and
+// returns nil if none arrived.
+func cmdStreamsReceive(s *session, args []any) (any, error) {
+	flags, args, err := parseFlags(args,
+		flagSpec{name: "visibility", short: "v", hasValue: true},
+		flagSpec{name: "count", short: "c", hasValue: true},
+		flagSpec{name: "block", short: "b", hasValue: true})
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	visibility := defaultVisibilityTimeout
+	if v, ok := flags["visibility"]; ok {
+		visibility, err = parseDuration(v)
+		if err != nil || visibility <= 0 {
+			return nil, fmt.Errorf("invalid duration: %s", v)
+		}
+	}
+	count := int64(1)
+	if c, ok := flags["count"]; ok {
+		count, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || count < 1 {
+			return nil, errors.New("count must be a positive integer")
+		}
+	}
+	receive := func(t *txn) (any, int64, error) {
+		return t.receive(name, count, visibility.Milliseconds())
+	}
+	block, ok := flags["block"]
+	if !ok {
+		var result any
+		err = s.userDB.update(s.ctx, func(t *txn) (err error) {
+			result, _, err = receive(t)
+			return err
+		})
+		if err != nil || result != nil {
+			return result, err
+		}
+		return []any{}, nil
+	}
+	timeout, err := parseDuration(block)
+	if err != nil {
+		return nil, err
+	}
+	return s.blockUntil(timeout, receive)
+}
+
+// leasedMessage checks that receipt is still valid for a message of an mpmc
+// stream and returns the id of the message.
+func (t *txn) leasedMessage(name, receipt string) (int64, error) {
+	_, err := t.getQueue(name)
+	if err != nil {
+		return 0, err
+	}
+	idPart, deliveriesPart, ok := strings.Cut(receipt, ".")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if !ok || err != nil {
+		return 0, errBadReceipt
+	}
+	deliveries, err := strconv.ParseInt(deliveriesPart, 10, 64)
+	if err != nil {
+		return 0, errBadReceipt
+	}
+	var valid bool
+	err = t.queryRow("SELECT EXISTS (SELECT 1 FROM queue_messages WHERE stream = ? AND id = ? AND deliveries = ?);",
+		name, id, deliveries).Scan(&valid)
+	if err != nil {
+		return 0, fmt.Errorf("could not check receipt: %w", err)
+	}
+	if !valid {
+		return 0, errLeaseLost
+	}
+	return id, nil
+}
+
+// cmdStreamsExtend implements STREAMS EXTEND name receipt duration, which
+// makes a received message invisible for the duration from now on.
+func cmdStreamsExtend(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	name, d := strs[0], strs[2]
+	visibility, err := parseDuration(d)
+	if err != nil || visibility <= 0 {
+		return nil, fmt.Errorf("invalid duration: %s", d)
+	}
+	id, err := t.leasedMessage(name, strs[1])
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.exec("UPDATE queue_messages SET visibleAt = ? WHERE stream = ? AND id = ?;",
+		t.now+visibility.Milliseconds(), name, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not extend lease: %w", err)
+	}
+	return "OK", nil
+}
+
+// cmdStreamsRemove implements STREAMS REMOVE name receipt, which removes a
+// received message from its stream once it has been processed.
+func cmdStreamsRemove(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	name := strs[0]
+	id, err := t.leasedMessage(name, strs[1])
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.exec("DELETE FROM queue_messages WHERE stream = ? AND id = ?;", name, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not remove message: %w", err)
+	}
+	return "OK", nil
+}
+
+// cmdStreamsRelease implements STREAMS RELEASE [--delay/-d duration] name
+// receipt, which makes a received message visible again, after the delay if
+// one is given.
+func cmdStreamsRelease(t *txn, args []any) (any, error) {
+	flags, args, err := parseFlags(args, flagSpec{name: "delay", short: "d", hasValue: true})
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	var delay time.Duration
+	if d, ok := flags["delay"]; ok {
+		delay, err = parseDuration(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	name := strs[0]
+	id, err := t.leasedMessage(name, strs[1])
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.exec("UPDATE queue_messages SET visibleAt = ? WHERE stream = ? AND id = ?;",
+		t.now+delay.Milliseconds(), name, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not release message: %w", err)
+	}
+	t.changed = true
+	return "OK", nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// In user-server mode every ssh connection runs its own process with its own
+// UserDB, so published messages are additionally written to the
+// pubsub_messages table. Every UserDB polls PRAGMA data_version, which only
+// changes when another connection wrote to the database, and relays new
+// messages of other origins to its local broker. It also wakes up blocking
+// commands, which wait for writes of other processes too.
+
+const (
+	// relayInterval is how often the relay checks for writes of other
+	// processes.
+	relayInterval = 50 * time.Millisecond
+	// relayRetention is how long relayed messages are kept in
+	// pubsub_messages, it must be much larger than relayInterval.
+	relayRetention = time.Minute
+	// relayCleanupInterval is how often old messages are removed.
+	relayCleanupInterval = 10 * time.Second
+)
+
+// publish sends message to all subscribers of channel in this and all other
+// processes using the same database. It returns the number of subscribers in
+// this process that received the message.
+func (db *UserDB) publish(channel, message string) (int, error) {
+	_, err := db.db.ExecContext(db.ctx,
+		"INSERT INTO pubsub_messages(channel, message, origin, created) VALUES (?, ?, ?, ?);",
+		channel, message, db.origin, time.Now().UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("could not store message: %w", err)
+	}
+	return db.pubsub.publish(channel, message), nil
+}
+
+// startRelay starts relaying messages published by other processes.
+func (db *UserDB) startRelay() error {
+	err := db.db.QueryRowContext(db.ctx, "SELECT COALESCE(MAX(id), 0) FROM pubsub_messages;").Scan(&db.lastMessageID)
+	if err != nil {
+		return fmt.Errorf("could not get last message id: %w", err)
+	}
+	db.workers.Add(1)
+	go db.relay()
+	return nil
+}
+
+func (db *UserDB) relay() {
+	defer db.workers.Done()
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+	var dataVersion int64
+	lastCleanup := time.Now()
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var version int64
+		err := db.db.QueryRowContext(db.ctx, "PRAGMA data_version;").Scan(&version)
+		if err != nil {
+			if db.ctx.Err() == nil {
+				db.logger.Error("Could not get data version", "error", err)
+			}
+			continue
+		}
+		if version != dataVersion {
+			dataVersion = version
+			db.signalChange()
+			err = db.relayMessages()
+			if err != nil && db.ctx.Err() == nil {
+				db.logger.Error("Could not relay messages", "error", err)
+			}
+		}
+		if time.Since(lastCleanup) > relayCleanupInterval {
+			lastCleanup = time.Now()
+			_, err = db.db.ExecContext(db.ctx, "DELETE FROM pubsub_messages WHERE created < ?;",
+				time.Now().Add(-relayRetention).UnixMilli())
+			if err != nil && db.ctx.Err() == nil {
+				db.logger.Error("Could not remove relayed messages", "error", err)
+			}
+		}
+	}
+}
+
+// relayMessages delivers all messages of other origins that were stored since
+// the last call to the local broker.
+func (db *UserDB) relayMessages() error {
+	rows, err := db.db.QueryContext(db.ctx,
+		"SELECT id, channel, message, origin FROM pubsub_messages WHERE id > ? ORDER BY id;",
+		db.lastMessageID)
+	if err != nil {
+		return fmt.Errorf("could not query messages: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var channel, message, origin string
+		err = rows.Scan(&id, &channel, &message, &origin)
+		if err != nil {
+			return fmt.Errorf("could not scan message: %w", err)
+		}
+		db.lastMessageID = id
+		if origin != db.origin {
+			db.pubsub.publish(channel, message)
+		}
+	}
+	return rows.Err()
+}
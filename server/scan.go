@@ -0,0 +1,246 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/tionis/ssh-data/util"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultScanCount is the number of keys SCAN examines per call by default.
+	defaultScanCount = 10
+	// defaultListCount is the number of entries LS returns by default.
+	defaultListCount = 100
+)
+
+// SCAN walks the keyspace in key order. Its cursor is the base64 encoded last
+// key examined by the previous call, so keys that are added or removed while
+// scanning never cause other keys to be skipped or returned twice. "0" starts
+// a new scan and is returned once the scan is complete.
+
+// decodeCursor returns the last key or field examined from a scan cursor, ""
+// for "0".
+func decodeCursor(cursor string) (string, error) {
+	if cursor == "0" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", errors.New("invalid cursor")
+	}
+	return string(b), nil
+}
+
+// encodeCursor returns the cursor continuing a scan after last.
+func encodeCursor(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// cmdScan implements SCAN cursor [MATCH patterns] [TYPE type] [COUNT n]. It
+// returns a list of the next cursor followed by the keys matching the
+// comma-separated pattern list and type among the next n keys.
+func cmdScan(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 7); err != nil {
+		return nil, err
+	}
+	cursor, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []*util.Pattern
+	var match, typ string
+	count := int64(defaultScanCount)
+	for i := 1; i < len(args); i += 2 {
+		option, err := argString(args, i)
+		if err != nil {
+			return nil, err
+		}
+		if i+1 >= len(args) {
+			return nil, errors.New("syntax error")
+		}
+		switch option = strings.ToUpper(option); option {
+		case "MATCH":
+			match, err = argString(args, i+1)
+			if err != nil {
+				return nil, err
+			}
+			patterns, err = util.ParsePatternList(match)
+		case "TYPE":
+			typ, err = argString(args, i+1)
+		case "COUNT":
+			count, err = argInt(args, i+1)
+			if err == nil && count < 1 {
+				err = errors.New("COUNT must be positive")
+			}
+		default:
+			err = fmt.Errorf("invalid option: %s", option)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	lower, upper := "", ""
+	if cursor != "0" {
+		lower = after
+	}
+	// A single pattern without wildcards at its start restricts the scan to
+	// the keys starting with its literal prefix.
+	if len(patterns) == 1 && !strings.HasPrefix(match, "!") {
+		if prefix := match[:strings.IndexAny(match+"*", "*?")]; prefix != "" {
+			if lower < prefix {
+				lower = prefix
+			}
+			upper = prefixEnd(prefix)
+		}
+	}
+	query := "SELECT key, type FROM data WHERE (validUntil = -1 OR validUntil > ?)"
+	queryArgs := []any{t.now}
+	if cursor != "0" {
+		query += " AND key > ?"
+		queryArgs = append(queryArgs, after)
+	}
+	if lower != after {
+		query += " AND key >= ?"
+		queryArgs = append(queryArgs, lower)
+	}
+	if upper != "" {
+		query += " AND key < ?"
+		queryArgs = append(queryArgs, upper)
+	}
+	rows, err := t.query(query+" ORDER BY key LIMIT ?;", append(queryArgs, count)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not scan keys: %w", err)
+	}
+	defer rows.Close()
+	result := []any{"0"}
+	var n int64
+	var last string
+	for rows.Next() {
+		var key, keyType string
+		err = rows.Scan(&key, &keyType)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan keys: %w", err)
+		}
+		n++
+		last = key
+		if typ != "" && keyType != typ {
+			continue
+		}
+		if patterns != nil && !util.MatchPatternList(patterns, key) {
+			continue
+		}
+		result = append(result, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan keys: %w", err)
+	}
+	if n == count {
+		result[0] = encodeCursor(last)
+	}
+	return result, nil
+}
+
+// cmdLs implements LS [--delimiter/-d delimiter] [--count/-c n]
+// [--after/-a entry] [prefix]. Like the listing of an object store, it returns
+// the keys starting with prefix that do not contain the delimiter (default
+// "/") after the prefix, and every distinct "directory" (the prefix up to and
+// including the next delimiter) once. Entries are returned in key order, up to
+// n (default 100) per call; a listing is continued by passing the last entry
+// as --after.
+func cmdLs(t *txn, args []any) (any, error) {
+	flags, args, err := parseFlags(args,
+		flagSpec{name: "delimiter", short: "d", hasValue: true},
+		flagSpec{name: "count", short: "c", hasValue: true},
+		flagSpec{name: "after", short: "a", hasValue: true})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkArgs(args, 0, 1); err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix, err = argString(args, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	delimiter := "/"
+	if d, ok := flags["delimiter"]; ok {
+		if d == "" {
+			return nil, errors.New("delimiter must not be empty")
+		}
+		delimiter = d
+	}
+	count := int64(defaultListCount)
+	if c, ok := flags["count"]; ok {
+		count, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || count < 1 {
+			return nil, errors.New("count must be a positive integer")
+		}
+	}
+	upper := prefixEnd(prefix)
+	// lower is the smallest key that may still be listed, after skipping a
+	// directory it is the first key after all keys in it.
+	lower, inclusive := prefix, true
+	if after, ok := flags["after"]; ok && after >= prefix {
+		lower, inclusive = after, false
+		if strings.HasPrefix(after, prefix) && strings.HasSuffix(after[len(prefix):], delimiter) {
+			lower, inclusive = prefixEnd(after), true
+		}
+	}
+	entries := []any{}
+	for int64(len(entries)) < count && (upper == "" || lower < upper) {
+		query := "SELECT key FROM data WHERE (validUntil = -1 OR validUntil > ?) AND key > ?"
+		if inclusive {
+			query = "SELECT key FROM data WHERE (validUntil = -1 OR validUntil > ?) AND key >= ?"
+		}
+		queryArgs := []any{t.now, lower}
+		if upper != "" {
+			query += " AND key < ?"
+			queryArgs = append(queryArgs, upper)
+		}
+		var key string
+		err = t.queryRow(query+" ORDER BY key LIMIT 1;", queryArgs...).Scan(&key)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not list keys: %w", err)
+		}
+		i := strings.Index(key[len(prefix):], delimiter)
+		if i == -1 {
+			entries = append(entries, key)
+			lower, inclusive = key, false
+			continue
+		}
+		dir := key[:len(prefix)+i+len(delimiter)]
+		entries = append(entries, dir)
+		lower, inclusive = prefixEnd(dir), true
+		if lower == "" {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// prefixEnd returns the smallest string greater than all strings starting
+// with prefix or "" if there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Messages published or appended with --at or --delay are stored in the
+// scheduled table until they are due and then delivered by a scheduler, which
+// every process sharing the database runs. A message is delivered and removed
+// from the table in the same transaction, so it is delivered once even if
+// several schedulers see it. Messages for mpmc streams are not scheduled but
+// queued as invisible until they are due, see queues.go.
+
+const (
+	// scheduleBatchSize is the maximum number of messages delivered per
+	// transaction.
+	scheduleBatchSize = 100
+	// scheduleRetryInterval is how long the scheduler waits after an error.
+	scheduleRetryInterval = time.Second
+)
+
+// scheduleFlags are the options of commands that can deliver messages later.
+var scheduleFlags = []flagSpec{
+	{name: "at", short: "a", hasValue: true},
+	{name: "delay", short: "d", hasValue: true},
+}
+
+// parseDueAt returns the time in unix milliseconds at which a message should
+// be delivered according to the --at or --delay option in flags, now if
+// neither is given.
+func parseDueAt(flags map[string]string, now int64) (int64, error) {
+	at, hasAt := flags["at"]
+	d, hasDelay := flags["delay"]
+	switch {
+	case hasAt && hasDelay:
+		return 0, errors.New("--at and --delay can not be used together")
+	case hasAt:
+		return parseTime(at)
+	case hasDelay:
+		delay, err := parseDuration(d)
+		if err != nil {
+			return 0, err
+		}
+		return now + delay.Milliseconds(), nil
+	default:
+		return now, nil
+	}
+}
+
+// schedule stores a message that is published on a channel or appended to a
+// stream (depending on column) at dueAt.
+func (t *txn) schedule(column, name, message string, dueAt int64) error {
+	_, err := t.exec("INSERT INTO scheduled("+column+", message, dueAt) VALUES (?, ?, ?);", name, message, dueAt)
+	if err != nil {
+		return fmt.Errorf("could not schedule message: %w", err)
+	}
+	// wake up the scheduler in case the message is due before all others
+	t.changed = true
+	return nil
+}
+
+// deliverScheduled delivers up to scheduleBatchSize due messages and returns
+// their number.
+func (t *txn) deliverScheduled() (int, error) {
+	rows, err := t.query(`SELECT id, channel, stream, message FROM scheduled WHERE dueAt <= ?
+		ORDER BY dueAt, id LIMIT ?;`, t.now, scheduleBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("could not query scheduled messages: %w", err)
+	}
+	type scheduledMessage struct {
+		id              int64
+		channel, stream sql.NullString
+		message         string
+	}
+	var messages []scheduledMessage
+	for rows.Next() {
+		var m scheduledMessage
+		err = rows.Scan(&m.id, &m.channel, &m.stream, &m.message)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("could not scan scheduled message: %w", err)
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("could not query scheduled messages: %w", err)
+	}
+	for _, m := range messages {
+		if m.channel.Valid {
+			err = t.publish(m.channel.String, m.message)
+		} else {
+			var st *stream
+			st, err = t.getStream(m.stream.String)
+			if err == nil {
+				_, err = t.appendEntry(st, m.message)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, err = t.exec("DELETE FROM scheduled WHERE id = ?;", m.id)
+		if err != nil {
+			return 0, fmt.Errorf("could not remove scheduled message: %w", err)
+		}
+	}
+	return len(messages), nil
+}
+
+// startScheduler starts delivering scheduled messages in the background.
+func (db *UserDB) startScheduler() {
+	db.workers.Add(1)
+	go db.runScheduler()
+}
+
+func (db *UserDB) runScheduler() {
+	defer db.workers.Done()
+	for {
+		changed := db.changes()
+		wait, err := db.dispatchScheduled()
+		if err != nil {
+			if db.ctx.Err() == nil {
+				db.logger.Error("Could not deliver scheduled messages", "error", err)
+			}
+			wait = scheduleRetryInterval
+		}
+		var due <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case <-db.ctx.Done():
+		case <-changed:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if db.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// dispatchScheduled delivers all due messages and returns the time until the
+// next message is due, 0 if there are none.
+func (db *UserDB) dispatchScheduled() (time.Duration, error) {
+	for {
+		var next sql.NullInt64
+		err := db.db.QueryRowContext(db.ctx, "SELECT min(dueAt) FROM scheduled;").Scan(&next)
+		if err != nil {
+			return 0, fmt.Errorf("could not query scheduled messages: %w", err)
+		}
+		if !next.Valid {
+			return 0, nil
+		}
+		if wait := time.Until(time.UnixMilli(next.Int64)); wait > 0 {
+			return wait, nil
+		}
+		var n int
+		err = db.update(db.ctx, func(t *txn) (err error) {
+			n, err = t.deliverScheduled()
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			db.logger.Debug("Delivered scheduled messages", "count", n)
+		}
+	}
+}
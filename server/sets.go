@@ -0,0 +1,270 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The members of a set are stored in the sets table, one row per member. Set
+// algebra is done by sqlite on the rows of all keys involved, which are
+// checked to be sets (or missing) first.
+
+// setMembers collects the rows of a query returning members.
+func (t *txn) setMembers(query string, args ...any) ([]string, error) {
+	rows, err := t.query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not get members: %w", err)
+	}
+	defer rows.Close()
+	members := []string{}
+	for rows.Next() {
+		var member string
+		err = rows.Scan(&member)
+		if err != nil {
+			return nil, fmt.Errorf("could not get members: %w", err)
+		}
+		members = append(members, member)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not get members: %w", err)
+	}
+	return members, nil
+}
+
+// storeSet replaces dst, whatever its type, with a set of members. An empty
+// set deletes dst.
+func (t *txn) storeSet(dst string, members []string, event string) error {
+	_, err := t.del(dst)
+	if err != nil || len(members) == 0 {
+		return err
+	}
+	err = t.createKey(dst, typeSet)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		_, err = t.exec("INSERT INTO sets(key, member) VALUES (?, ?);", dst, member)
+		if err != nil {
+			return fmt.Errorf("could not add member: %w", err)
+		}
+	}
+	return t.modified(dst, event)
+}
+
+// membersResult converts members to a command result.
+func membersResult(members []string) []any {
+	result := make([]any, len(members))
+	for i, member := range members {
+		result[i] = member
+	}
+	return result
+}
+
+// cmdSAdd implements SADD key member... and returns the number of members
+// that were added.
+func cmdSAdd(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, -1); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	key := strs[0]
+	err = t.createKey(key, typeSet)
+	if err != nil {
+		return nil, err
+	}
+	var added int64
+	for _, member := range strs[1:] {
+		res, err := t.exec("INSERT INTO sets(key, member) VALUES (?, ?) ON CONFLICT DO NOTHING;", key, member)
+		if err != nil {
+			return nil, fmt.Errorf("could not add member: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("could not add member: %w", err)
+		}
+		added += n
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	return added, t.modified(key, "sadd")
+}
+
+// cmdSRem implements SREM key member... and returns the number of members
+// that were removed. The key is deleted with its last member.
+func cmdSRem(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, -1); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	key := strs[0]
+	ok, err := t.checkType(key, typeSet)
+	if err != nil || !ok {
+		return 0, err
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return nil, err
+	}
+	var removed int64
+	for _, member := range strs[1:] {
+		res, err := t.exec("DELETE FROM sets WHERE key = ? AND member = ?;", key, member)
+		if err != nil {
+			return nil, fmt.Errorf("could not remove member: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("could not remove member: %w", err)
+		}
+		removed += n
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	err = t.modified(key, "srem")
+	if err != nil {
+		return nil, err
+	}
+	return removed, t.deleteIfEmpty(key, "sets")
+}
+
+// cmdSMembers implements SMEMBERS key, the members are returned in order.
+func cmdSMembers(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.checkType(key, typeSet)
+	if err != nil {
+		return nil, err
+	}
+	members, err := t.setMembers("SELECT member FROM sets WHERE key = ? ORDER BY member;", key)
+	if err != nil {
+		return nil, err
+	}
+	return membersResult(members), nil
+}
+
+// cmdSIsMember implements SISMEMBER key member and returns 1 if member is in
+// the set and 0 otherwise.
+func cmdSIsMember(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := t.checkType(strs[0], typeSet)
+	if err != nil || !ok {
+		return 0, err
+	}
+	var isMember int64
+	err = t.queryRow("SELECT EXISTS (SELECT 1 FROM sets WHERE key = ? AND member = ?);",
+		strs[0], strs[1]).Scan(&isMember)
+	if err != nil {
+		return nil, fmt.Errorf("could not check member: %w", err)
+	}
+	return isMember, nil
+}
+
+// cmdSCard implements SCARD key and returns the number of members.
+func cmdSCard(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := t.checkType(key, typeSet)
+	if err != nil || !ok {
+		return 0, err
+	}
+	var n int64
+	err = t.queryRow("SELECT count(*) FROM sets WHERE key = ?;", key).Scan(&n)
+	if err != nil {
+		return nil, fmt.Errorf("could not count members: %w", err)
+	}
+	return n, nil
+}
+
+// setOperation computes the intersection, union or difference of the sets
+// in keys, missing keys count as empty sets.
+func (t *txn) setOperation(operation string, keys []string) ([]string, error) {
+	args := make([]any, 0, len(keys)+1)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		_, err := t.checkType(key, typeSet)
+		if err != nil {
+			return nil, err
+		}
+		// Duplicate keys would break counting the sets a member is in.
+		if !seen[key] || operation == "diff" {
+			seen[key] = true
+			args = append(args, key)
+		}
+	}
+	placeholders := func(n int) string {
+		return "?" + strings.Repeat(", ?", n-1)
+	}
+	switch operation {
+	case "inter":
+		return t.setMembers("SELECT member FROM sets WHERE key IN ("+placeholders(len(args))+
+			") GROUP BY member HAVING count(*) = ? ORDER BY member;", append(args, len(args))...)
+	case "union":
+		return t.setMembers("SELECT DISTINCT member FROM sets WHERE key IN ("+placeholders(len(args))+
+			") ORDER BY member;", args...)
+	default:
+		query := "SELECT member FROM sets WHERE key = ?"
+		if len(args) > 1 {
+			query += " AND member NOT IN (SELECT member FROM sets WHERE key IN (" + placeholders(len(args)-1) + "))"
+		}
+		return t.setMembers(query+" ORDER BY member;", args...)
+	}
+}
+
+// setOperationCommand returns the implementation of SINTER, SUNION and SDIFF
+// key..., and of SINTERSTORE, SUNIONSTORE and SDIFFSTORE destination key...
+// if store is set. The latter store the resulting set in destination and
+// return the number of its members.
+func setOperationCommand(operation string, store bool) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		n := 1
+		if store {
+			n = 2
+		}
+		if err := checkArgs(args, n, -1); err != nil {
+			return nil, err
+		}
+		keys, err := argStrings(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		if !store {
+			members, err := t.setOperation(operation, keys)
+			if err != nil {
+				return nil, err
+			}
+			return membersResult(members), nil
+		}
+		members, err := t.setOperation(operation, keys[1:])
+		if err != nil {
+			return nil, err
+		}
+		err = t.storeSet(keys[0], members, "s"+operation+"store")
+		if err != nil {
+			return nil, err
+		}
+		return len(members), nil
+	}
+}
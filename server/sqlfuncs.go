@@ -0,0 +1,52 @@
+package server
+
+import (
+	"database/sql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// driverName is the name of the sqlite driver with the custom SQL functions
+// below registered on every connection. They are also available to the sql
+// command. The functions work on bytes and return blobs, as go-sqlite3 cuts
+// off text results at the first zero byte, so their results have to be cast
+// to TEXT (and an empty blob is returned as NULL).
+const driverName = "sqlite3_ssh_data"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterFunc("getrange", getRange, true)
+			if err != nil {
+				return err
+			}
+			return conn.RegisterFunc("setrange", setRange, true)
+		},
+	})
+}
+
+// getRange returns the bytes of value between start and end (both inclusive),
+// negative offsets count from the end of value.
+func getRange(value []byte, start, end int64) []byte {
+	n := int64(len(value))
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = n + end
+	}
+	end = min(end, n-1)
+	if start > end {
+		return nil
+	}
+	return value[start : end+1]
+}
+
+// setRange overwrites the bytes of value starting at offset with patch, value
+// is padded with zero bytes if it is shorter than offset.
+func setRange(value []byte, offset int64, patch []byte) []byte {
+	end := offset + int64(len(patch))
+	result := make([]byte, max(end, int64(len(value))))
+	copy(result, value)
+	copy(result[offset:], patch)
+	return result
+}
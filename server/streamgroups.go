@@ -0,0 +1,456 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consumer groups deliver every entry of a persistent stream to one consumer
+// of the group. Delivered entries stay pending in stream_pending until they
+// are acknowledged; pending entries that were not acknowledged within the idle
+// timeout of the group are delivered again, to whichever consumer reads next.
+// Entries that were delivered max deliveries times without being acknowledged
+// are moved to a dead-letter stream instead. Pending entries that are trimmed
+// from their stream are dropped.
+
+const defaultIdleTimeout = time.Minute
+
+var (
+	errNoSuchGroup = errors.New("no such group")
+	errGroupExists = errors.New("group already exists")
+)
+
+// streamGroup holds the settings of a consumer group.
+type streamGroup struct {
+	stream string
+	name   string
+	// lastID is the id of the last entry delivered to the group for the
+	// first time.
+	lastID int64
+	// idleTimeout is the time in milliseconds after which unacknowledged
+	// entries are delivered again.
+	idleTimeout int64
+	// maxDeliveries is the number of deliveries after which an entry is
+	// moved to deadLetter, 0 if unlimited.
+	maxDeliveries int64
+	deadLetter    string
+}
+
+// groupEntry is an entry delivered to a consumer of a group.
+type groupEntry struct {
+	streamEntry
+	// Deliveries is the number of times the entry was delivered, including
+	// this one.
+	Deliveries int64 `json:"deliveries"`
+}
+
+// getGroup returns the settings of a consumer group.
+func (t *txn) getGroup(stream, name string) (*streamGroup, error) {
+	g := &streamGroup{stream: stream, name: name}
+	err := t.queryRow("SELECT lastID, idleTimeout, maxDeliveries, deadLetter FROM stream_groups"+
+		" WHERE stream = ? AND name = ?;", stream, name).Scan(&g.lastID, &g.idleTimeout, &g.maxDeliveries, &g.deadLetter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNoSuchGroup
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get group: %w", err)
+	}
+	return g, nil
+}
+
+// cmdStreamsGroup implements STREAMS GROUP CREATE [--start/-s id]
+// [--idle/-i duration] [--max-deliveries/-m n] [--dead-letter/-d stream] name
+// group and STREAMS GROUP DELETE name group.
+func cmdStreamsGroup(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	subcommand, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToUpper(subcommand) {
+	case "CREATE":
+		return t.createGroup(args[1:])
+	case "DELETE":
+		if err := checkArgs(args, 3, 3); err != nil {
+			return nil, err
+		}
+		strs, err := argStrings(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		res, err := t.exec("DELETE FROM stream_groups WHERE stream = ? AND name = ?;", strs[0], strs[1])
+		if err != nil {
+			return nil, fmt.Errorf("could not delete group: %w", err)
+		}
+		return res.RowsAffected()
+	default:
+		return nil, fmt.Errorf("invalid subcommand: %s", subcommand)
+	}
+}
+
+func (t *txn) createGroup(args []any) (any, error) {
+	flags, args, err := parseFlags(args,
+		flagSpec{name: "start", short: "s", hasValue: true},
+		flagSpec{name: "idle", short: "i", hasValue: true},
+		flagSpec{name: "max-deliveries", short: "m", hasValue: true},
+		flagSpec{name: "dead-letter", short: "d", hasValue: true})
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	st, err := t.getStream(strs[0])
+	if err != nil {
+		return nil, err
+	}
+	if st.mpmc {
+		return nil, errStreamIsQueue
+	}
+	if !st.persistent {
+		return nil, errors.New("consumer groups require a persistent stream")
+	}
+	g := &streamGroup{stream: st.name, name: strs[1], idleTimeout: defaultIdleTimeout.Milliseconds()}
+	if start, ok := flags["start"]; ok {
+		if start == "$" {
+			g.lastID = st.lastID
+		} else {
+			g.lastID, err = strconv.ParseInt(start, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id: %s", start)
+			}
+		}
+	}
+	if idle, ok := flags["idle"]; ok {
+		d, err := parseDuration(idle)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration: %s", idle)
+		}
+		g.idleTimeout = d.Milliseconds()
+	}
+	if m, ok := flags["max-deliveries"]; ok {
+		g.maxDeliveries, err = strconv.ParseInt(m, 10, 64)
+		if err != nil || g.maxDeliveries < 1 {
+			return nil, errors.New("max deliveries must be a positive integer")
+		}
+		g.deadLetter = st.name + ":" + g.name + ":dead-letter"
+	}
+	if d, ok := flags["dead-letter"]; ok {
+		if g.maxDeliveries == 0 {
+			return nil, errors.New("a dead-letter stream requires max deliveries")
+		}
+		g.deadLetter = d
+	}
+	res, err := t.exec(`INSERT INTO stream_groups(stream, name, lastID, idleTimeout, maxDeliveries, deadLetter)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING;`,
+		g.stream, g.name, g.lastID, g.idleTimeout, g.maxDeliveries, g.deadLetter)
+	if err != nil {
+		return nil, fmt.Errorf("could not create group: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("could not create group: %w", err)
+	}
+	if n == 0 {
+		return nil, errGroupExists
+	}
+	return "OK", nil
+}
+
+// deadLetter moves a pending entry to the dead-letter stream of its group,
+// which is created as persistent stream if it does not exist. The data of the
+// dead-letter entry is a JSON object with the stream, group, id, deliveries
+// and data of the entry.
+func (t *txn) deadLetter(g *streamGroup, entry groupEntry) error {
+	_, err := t.exec("INSERT INTO streams(name, persistent, lastID) VALUES (?, TRUE, "+streamLastID+") ON CONFLICT DO NOTHING;",
+		g.deadLetter, streamCounter(g.deadLetter))
+	if err != nil {
+		return fmt.Errorf("could not create dead-letter stream: %w", err)
+	}
+	st, err := t.getStream(g.deadLetter)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]any{
+		"stream":     g.stream,
+		"group":      g.name,
+		"id":         entry.ID,
+		"deliveries": entry.Deliveries,
+		"data":       entry.Data,
+	})
+	if err != nil {
+		return err
+	}
+	if st.mpmc {
+		_, err = t.enqueue(st, string(data), 0, t.now)
+	} else {
+		_, err = t.appendEntry(st, string(data))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = t.exec("DELETE FROM stream_pending WHERE stream = ? AND grp = ? AND id = ?;", g.stream, g.name, entry.ID)
+	if err != nil {
+		return fmt.Errorf("could not remove pending entry: %w", err)
+	}
+	return nil
+}
+
+// readGroup delivers up to count entries to a consumer of a group: first the
+// pending entries whose idle timeout expired, then entries that were not yet
+// delivered to the group. It returns nil if there are none and the time at
+// which the next pending entry times out (0 if none is pending).
+func (t *txn) readGroup(stream, group, consumer string, count int64) (any, int64, error) {
+	g, err := t.getGroup(stream, group)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := t.query(`SELECT e.id, e.time, e.data, p.deliveries FROM stream_pending p
+		JOIN stream_entries e ON e.stream = p.stream AND e.id = p.id
+		WHERE p.stream = ? AND p.grp = ? AND p.deliveredAt <= ? ORDER BY p.id LIMIT ?;`,
+		stream, group, t.now-g.idleTimeout, count)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read pending entries: %w", err)
+	}
+	var expired []groupEntry
+	for rows.Next() {
+		var entry groupEntry
+		err = rows.Scan(&entry.ID, &entry.Time, &entry.Data, &entry.Deliveries)
+		if err != nil {
+			rows.Close()
+			return nil, 0, fmt.Errorf("could not read pending entries: %w", err)
+		}
+		expired = append(expired, entry)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("could not read pending entries: %w", err)
+	}
+	var entries []any
+	for _, entry := range expired {
+		if g.maxDeliveries > 0 && entry.Deliveries >= g.maxDeliveries {
+			err = t.deadLetter(g, entry)
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		entry.Deliveries++
+		_, err = t.exec(`UPDATE stream_pending SET consumer = ?, deliveredAt = ?, deliveries = ?
+			WHERE stream = ? AND grp = ? AND id = ?;`, consumer, t.now, entry.Deliveries, stream, group, entry.ID)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not deliver entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if n := count - int64(len(entries)); n > 0 {
+		rows, err = t.query("SELECT id, time, data FROM stream_entries WHERE stream = ? AND id > ? ORDER BY id LIMIT ?;",
+			stream, g.lastID, n)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not read entries: %w", err)
+		}
+		var fresh []groupEntry
+		for rows.Next() {
+			entry := groupEntry{Deliveries: 1}
+			err = rows.Scan(&entry.ID, &entry.Time, &entry.Data)
+			if err != nil {
+				rows.Close()
+				return nil, 0, fmt.Errorf("could not read entries: %w", err)
+			}
+			fresh = append(fresh, entry)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, 0, fmt.Errorf("could not read entries: %w", err)
+		}
+		for _, entry := range fresh {
+			_, err = t.exec(`INSERT INTO stream_pending(stream, grp, id, consumer, deliveredAt, deliveries)
+				VALUES (?, ?, ?, ?, ?, 1);`, stream, group, entry.ID, consumer, t.now)
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not deliver entry: %w", err)
+			}
+			entries = append(entries, entry)
+		}
+		if len(fresh) > 0 {
+			_, err = t.exec("UPDATE stream_groups SET lastID = ? WHERE stream = ? AND name = ?;",
+				fresh[len(fresh)-1].ID, stream, group)
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not deliver entry: %w", err)
+			}
+		}
+	}
+	if entries != nil {
+		return entries, 0, nil
+	}
+	var next sql.NullInt64
+	err = t.queryRow("SELECT min(deliveredAt) FROM stream_pending WHERE stream = ? AND grp = ?;", stream, group).
+		Scan(&next)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read pending entries: %w", err)
+	}
+	if !next.Valid {
+		return nil, 0, nil
+	}
+	return nil, next.Int64 + g.idleTimeout, nil
+}
+
+// cmdStreamsReadGroup implements STREAMS READGROUP [--count/-c n]
+// [--block/-b duration] name group consumer. It delivers up to n (default 100)
+// entries to the consumer and returns them like READ, with the number of
+// deliveries of each entry. With --block it waits up to the duration (0
+// meaning forever) for entries if there are none yet and returns nil if none
+// arrived.
+func cmdStreamsReadGroup(s *session, args []any) (any, error) {
+	flags, args, err := parseFlags(args,
+		flagSpec{name: "count", short: "c", hasValue: true},
+		flagSpec{name: "block", short: "b", hasValue: true})
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	count := int64(defaultStreamReadCount)
+	if c, ok := flags["count"]; ok {
+		count, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || count < 1 {
+			return nil, errors.New("count must be a positive integer")
+		}
+	}
+	readGroup := func(t *txn) (any, int64, error) {
+		return t.readGroup(strs[0], strs[1], strs[2], count)
+	}
+	block, ok := flags["block"]
+	if !ok {
+		var result any
+		err = s.userDB.update(s.ctx, func(t *txn) (err error) {
+			result, _, err = readGroup(t)
+			return err
+		})
+		if err != nil || result != nil {
+			return result, err
+		}
+		return []any{}, nil
+	}
+	timeout, err := parseDuration(block)
+	if err != nil {
+		return nil, err
+	}
+	return s.blockUntil(timeout, readGroup)
+}
+
+// cmdStreamsAck implements STREAMS ACK name group id..., which removes entries
+// from the pending entries of a group. It returns the number of entries that
+// were pending.
+func cmdStreamsAck(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, -1); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.getGroup(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	var acked int64
+	for _, s := range strs[2:] {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %s", s)
+		}
+		res, err := t.exec("DELETE FROM stream_pending WHERE stream = ? AND grp = ? AND id = ?;", strs[0], strs[1], id)
+		if err != nil {
+			return nil, fmt.Errorf("could not acknowledge entry: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("could not acknowledge entry: %w", err)
+		}
+		acked += n
+	}
+	return acked, nil
+}
+
+// pendingEntry describes a pending entry of a consumer group.
+type pendingEntry struct {
+	ID       int64  `json:"id"`
+	Consumer string `json:"consumer"`
+	// Deliveries is the number of times the entry was delivered.
+	Deliveries int64 `json:"deliveries"`
+	// Idle is the time in milliseconds since the last delivery.
+	Idle int64 `json:"idle"`
+}
+
+// cmdStreamsPending implements STREAMS PENDING [--consumer/-C consumer]
+// [--count/-c n] name group, which returns up to n (default 100) pending
+// entries of a group in id order with the consumer they were last delivered
+// to, their number of deliveries and the time since the last delivery.
+func cmdStreamsPending(t *txn, args []any) (any, error) {
+	flags, args, err := parseFlags(args,
+		flagSpec{name: "consumer", short: "C", hasValue: true},
+		flagSpec{name: "count", short: "c", hasValue: true})
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.getGroup(strs[0], strs[1])
+	if err != nil {
+		return nil, err
+	}
+	count := int64(defaultStreamReadCount)
+	if c, ok := flags["count"]; ok {
+		count, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || count < 1 {
+			return nil, errors.New("count must be a positive integer")
+		}
+	}
+	query := "SELECT id, consumer, deliveries, deliveredAt FROM stream_pending WHERE stream = ? AND grp = ?"
+	queryArgs := []any{strs[0], strs[1]}
+	if consumer, ok := flags["consumer"]; ok {
+		query += " AND consumer = ?"
+		queryArgs = append(queryArgs, consumer)
+	}
+	rows, err := t.query(query+" ORDER BY id LIMIT ?;", append(queryArgs, count)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list pending entries: %w", err)
+	}
+	defer rows.Close()
+	entries := []any{}
+	for rows.Next() {
+		var entry pendingEntry
+		var deliveredAt int64
+		err = rows.Scan(&entry.ID, &entry.Consumer, &entry.Deliveries, &deliveredAt)
+		if err != nil {
+			return nil, fmt.Errorf("could not list pending entries: %w", err)
+		}
+		entry.Idle = t.now - deliveredAt
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not list pending entries: %w", err)
+	}
+	return entries, nil
+}
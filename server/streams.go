@@ -0,0 +1,431 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Streams are named, append-only sequences of entries with increasing ids.
+// Every entry is published on the channel with the name of the stream, so
+// streams can be subscribed to like any channel. Persistent streams also keep
+// their entries in the stream_entries table (the latest size entries if a
+// size is set), from where they are read by id or time, so a reader that
+// reconnects can resume after the last entry it has seen. Entries of mpmc
+// streams are not published but queued, see queues.go.
+//
+// The last id of a deleted stream is kept in the counter stream:<name>, so a
+// stream that is created again with the same name continues after it and ids
+// never go backwards for a name.
+
+const defaultStreamReadCount = 100
+
+var (
+	errNoSuchStream        = errors.New("no such stream")
+	errStreamExists        = errors.New("stream already exists")
+	errStreamNotPersistent = errors.New("stream is not persistent, subscribe to its channel instead")
+	errStreamIsQueue       = errors.New("stream is an mpmc stream, use RECEIVE instead")
+)
+
+// stream holds the settings of a stream.
+type stream struct {
+	name       string
+	persistent bool
+	mpmc       bool
+	// size is the maximum number of entries kept (of messages queued for mpmc
+	// streams), 0 if unlimited.
+	size   int64
+	lastID int64
+}
+
+// streamEntry is an entry of a stream as returned to clients and published
+// on its channel.
+type streamEntry struct {
+	ID int64 `json:"id"`
+	// Time is the time the entry was appended in unix milliseconds.
+	Time int64  `json:"time"`
+	Data string `json:"data"`
+}
+
+// streamCommands maps the lower-case subcommands of STREAMS that do not block
+// to their implementation.
+var streamCommands = map[string]dataCommandFunc{
+	"create":  cmdStreamsCreate,
+	"delete":  cmdStreamsDelete,
+	"append":  cmdStreamsAppend,
+	"info":    cmdStreamsInfo,
+	"group":   cmdStreamsGroup,
+	"ack":     cmdStreamsAck,
+	"pending": cmdStreamsPending,
+	"extend":  cmdStreamsExtend,
+	"remove":  cmdStreamsRemove,
+	"release": cmdStreamsRelease,
+}
+
+// blockingStreamCommands maps the lower-case subcommands of STREAMS that may
+// block to their implementation.
+var blockingStreamCommands = map[string]commandFunc{
+	"read":      cmdStreamsRead,
+	"readgroup": cmdStreamsReadGroup,
+	"receive":   cmdStreamsReceive,
+}
+
+// cmdStreams implements STREAMS subcommand [args...]. Subcommands that may
+// block are executed by the session, all others are data commands.
+func cmdStreams(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	subcommand, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	subcommand = strings.ToLower(subcommand)
+	if fn, ok := blockingStreamCommands[subcommand]; ok {
+		return fn(s, args[1:])
+	}
+	fn, ok := streamCommands[subcommand]
+	if !ok {
+		return nil, fmt.Errorf("invalid subcommand: %s", subcommand)
+	}
+	var result any
+	err = s.userDB.update(s.ctx, func(t *txn) error {
+		result, err = fn(t, args[1:])
+		return err
+	})
+	return result, err
+}
+
+// parseTime parses a time given as unix milliseconds or in RFC 3339 format and
+// returns it in unix milliseconds.
+func parseTime(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time, expected unix milliseconds or RFC 3339: %s", s)
+	}
+	return t.UnixMilli(), nil
+}
+
+// streamCounter returns the name of the counter that keeps the last id of a
+// deleted stream.
+func streamCounter(name string) string {
+	return "stream:" + name
+}
+
+// streamLastID is an SQL expression for the initial lastID of a stream created
+// with the name given as parameter.
+const streamLastID = "COALESCE((SELECT value FROM counters WHERE name = ?), 0)"
+
+// getStream returns the settings of a stream.
+func (t *txn) getStream(name string) (*stream, error) {
+	st := &stream{name: name}
+	err := t.queryRow("SELECT persistent, mpmc, size, lastID FROM streams WHERE name = ?;", name).
+		Scan(&st.persistent, &st.mpmc, &st.size, &st.lastID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNoSuchStream
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get stream: %w", err)
+	}
+	return st, nil
+}
+
+// cmdStreamsCreate implements STREAMS CREATE [--persistent/-p] [--size/-s n]
+// [--mpmc/-m] name.
+func cmdStreamsCreate(t *txn, args []any) (any, error) {
+	flags, args, err := parseFlags(args,
+		flagSpec{name: "persistent", short: "p"},
+		flagSpec{name: "size", short: "s", hasValue: true},
+		flagSpec{name: "mpmc", short: "m"})
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, persistent := flags["persistent"]
+	_, mpmc := flags["mpmc"]
+	if persistent && mpmc {
+		return nil, errors.New("mpmc streams are always persistent, --persistent can not be used with --mpmc")
+	}
+	var size int64
+	if s, ok := flags["size"]; ok {
+		size, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || size < 1 {
+			return nil, errors.New("size must be a positive integer")
+		}
+		if !persistent && !mpmc {
+			return nil, errors.New("size requires a persistent or mpmc stream")
+		}
+	}
+	res, err := t.exec("INSERT INTO streams(name, persistent, mpmc, size, lastID) VALUES (?, ?, ?, ?, "+streamLastID+")"+
+		" ON CONFLICT DO NOTHING;", name, persistent, mpmc, size, streamCounter(name))
+	if err != nil {
+		return nil, fmt.Errorf("could not create stream: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("could not create stream: %w", err)
+	}
+	if n == 0 {
+		return nil, errStreamExists
+	}
+	return "OK", nil
+}
+
+// cmdStreamsDelete implements STREAMS DELETE name, which deletes a stream with
+// all its entries. It returns 1 if the stream existed and 0 otherwise.
+func cmdStreamsDelete(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.exec(`INSERT INTO counters(name, value) SELECT ?, lastID FROM streams WHERE name = ?
+		ON CONFLICT(name) DO UPDATE SET value = max(value, excluded.value);`, streamCounter(name), name)
+	if err != nil {
+		return nil, fmt.Errorf("could not delete stream: %w", err)
+	}
+	res, err := t.exec("DELETE FROM streams WHERE name = ?;", name)
+	if err != nil {
+		return nil, fmt.Errorf("could not delete stream: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// appendEntry appends an entry to a stream, publishes it on the channel of
+// the stream and returns its id.
+func (t *txn) appendEntry(st *stream, data string) (int64, error) {
+	entry := streamEntry{ID: st.lastID + 1, Time: t.now, Data: data}
+	_, err := t.exec("UPDATE streams SET lastID = ? WHERE name = ?;", entry.ID, st.name)
+	if err != nil {
+		return 0, fmt.Errorf("could not append entry: %w", err)
+	}
+	st.lastID = entry.ID
+	if st.persistent {
+		_, err = t.exec("INSERT INTO stream_entries(stream, id, time, data) VALUES (?, ?, ?, ?);",
+			st.name, entry.ID, entry.Time, entry.Data)
+		if err != nil {
+			return 0, fmt.Errorf("could not append entry: %w", err)
+		}
+		if st.size > 0 {
+			_, err = t.exec("DELETE FROM stream_entries WHERE stream = ? AND id <= ?;", st.name, entry.ID-st.size)
+			if err != nil {
+				return 0, fmt.Errorf("could not trim stream: %w", err)
+			}
+		}
+		t.changed = true
+	}
+	message, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	return entry.ID, t.publish(st.name, string(message))
+}
+
+// cmdStreamsAppend implements STREAMS APPEND [--priority/-P n] [--at/-a time]
+// [--delay/-d duration] name data and returns the id of the new entry.
+// Priorities are only supported by mpmc streams, entries of other streams
+// that are not due yet are scheduled and the command returns OK instead.
+func cmdStreamsAppend(t *txn, args []any) (any, error) {
+	flags, args, err := parseFlags(args, append([]flagSpec{
+		{name: "priority", short: "P", hasValue: true}}, scheduleFlags...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	dueAt, err := parseDueAt(flags, t.now)
+	if err != nil {
+		return nil, err
+	}
+	st, err := t.getStream(strs[0])
+	if err != nil {
+		return nil, err
+	}
+	if !st.mpmc {
+		if _, ok := flags["priority"]; ok {
+			return nil, errors.New("--priority requires an mpmc stream")
+		}
+		if dueAt > t.now {
+			err = t.schedule("stream", st.name, strs[1], dueAt)
+			if err != nil {
+				return nil, err
+			}
+			return "OK", nil
+		}
+		return t.appendEntry(st, strs[1])
+	}
+	var priority int64
+	if p, ok := flags["priority"]; ok {
+		priority, err = strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority: %s", p)
+		}
+	}
+	return t.enqueue(st, strs[1], priority, max(dueAt, t.now))
+}
+
+// cmdStreamsInfo implements STREAMS INFO name, which returns the settings of
+// a stream, the number of entries it holds and the ids of the first and last
+// of them.
+func cmdStreamsInfo(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	st, err := t.getStream(name)
+	if err != nil {
+		return nil, err
+	}
+	table := "stream_entries"
+	if st.mpmc {
+		table = "queue_messages"
+	}
+	var length, first int64
+	err = t.queryRow("SELECT count(*), coalesce(min(id), 0) FROM "+table+" WHERE stream = ?;", name).
+		Scan(&length, &first)
+	if err != nil {
+		return nil, fmt.Errorf("could not get stream: %w", err)
+	}
+	return map[string]any{
+		"persistent": st.persistent || st.mpmc,
+		"mpmc":       st.mpmc,
+		"size":       st.size,
+		"length":     length,
+		"first":      first,
+		"last":       st.lastID,
+	}, nil
+}
+
+// readEntries returns up to count entries of a persistent stream with an id
+// after after and a time not before since, nil if there are none.
+func (t *txn) readEntries(name string, after, since, count int64) (any, error) {
+	st, err := t.getStream(name)
+	if err != nil {
+		return nil, err
+	}
+	if st.mpmc {
+		return nil, errStreamIsQueue
+	}
+	if !st.persistent {
+		return nil, errStreamNotPersistent
+	}
+	rows, err := t.query("SELECT id, time, data FROM stream_entries WHERE stream = ? AND id > ? AND time >= ?"+
+		" ORDER BY id LIMIT ?;", name, after, since, count)
+	if err != nil {
+		return nil, fmt.Errorf("could not read entries: %w", err)
+	}
+	defer rows.Close()
+	var entries []any
+	for rows.Next() {
+		var entry streamEntry
+		err = rows.Scan(&entry.ID, &entry.Time, &entry.Data)
+		if err != nil {
+			return nil, fmt.Errorf("could not read entries: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not read entries: %w", err)
+	}
+	if entries == nil {
+		return nil, nil
+	}
+	return entries, nil
+}
+
+// cmdStreamsRead implements STREAMS READ [--after/-a id] [--since/-s time]
+// [--count/-c n] [--block/-b duration] name. It returns up to n (default 100)
+// entries of a persistent stream with an id after the given one ("$" meaning
+// the last entry) and a time not before the given one, as a list of objects
+// with the id, time and data of the entry. With --block it waits up to the
+// duration (0 meaning forever) for such entries if there are none yet and
+// returns nil if none arrived.
+func cmdStreamsRead(s *session, args []any) (any, error) {
+	flags, args, err := parseFlags(args,
+		flagSpec{name: "after", short: "a", hasValue: true},
+		flagSpec{name: "since", short: "s", hasValue: true},
+		flagSpec{name: "count", short: "c", hasValue: true},
+		flagSpec{name: "block", short: "b", hasValue: true})
+	if err != nil {
+		return nil, err
+	}
+	if err = checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	name, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	var after, since int64
+	if a, ok := flags["after"]; ok && a != "$" {
+		after, err = strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %s", a)
+		}
+	}
+	if a, ok := flags["since"]; ok {
+		since, err = parseTime(a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	count := int64(defaultStreamReadCount)
+	if c, ok := flags["count"]; ok {
+		count, err = strconv.ParseInt(c, 10, 64)
+		if err != nil || count < 1 {
+			return nil, errors.New("count must be a positive integer")
+		}
+	}
+	var timeout time.Duration
+	block, blocking := flags["block"]
+	if blocking {
+		timeout, err = parseDuration(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var result any
+	err = s.userDB.update(s.ctx, func(t *txn) error {
+		if flags["after"] == "$" {
+			st, err := t.getStream(name)
+			if err != nil {
+				return err
+			}
+			after = st.lastID
+		}
+		result, err = t.readEntries(name, after, since, count)
+		return err
+	})
+	if err != nil || result != nil {
+		return result, err
+	}
+	if !blocking {
+		return []any{}, nil
+	}
+	return s.block(timeout, func(t *txn, _ []any) (any, error) {
+		return t.readEntries(name, after, since, count)
+	}, nil)
+}
@@ -0,0 +1,541 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// getString returns the value of a string key and whether it exists.
+func (t *txn) getString(key string) (string, bool, error) {
+	err := t.expire(key)
+	if err != nil {
+		return "", false, err
+	}
+	var typ, value string
+	err = t.queryRow("SELECT type, value FROM data WHERE key = ?;", key).Scan(&typ, &value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("could not get key: %w", err)
+	}
+	if typ != typeString {
+		return "", false, errWrongType
+	}
+	return value, true, nil
+}
+
+// setString sets key to a string value, keys of another type are refused with
+// errWrongType. The expiry of the key is removed unless keepTTL is set.
+func (t *txn) setString(key, value string, keepTTL bool) error {
+	err := t.checkLock(key)
+	if err != nil {
+		return err
+	}
+	_, err = t.checkType(key, typeString)
+	if err != nil {
+		return err
+	}
+	err = t.checkNoSchema(key)
+	if err != nil {
+		return err
+	}
+	_, err = t.exec(`INSERT INTO data(key, type, value) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET type = excluded.type, value = excluded.value,
+			validUntil = CASE WHEN ? THEN validUntil ELSE -1 END;`,
+		key, typeString, value, keepTTL)
+	if err != nil {
+		return fmt.Errorf("could not set key: %w", err)
+	}
+	_, err = t.bumpVersion(key)
+	if err != nil {
+		return err
+	}
+	return t.notify("set", key)
+}
+
+// cmdGet implements GET key [WITHVERSION]. With WITHVERSION it returns the
+// value together with its version, [nil, 0] if the key does not exist.
+func cmdGet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	withVersion := false
+	if len(args) == 2 {
+		option, err := argString(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ToUpper(option) != "WITHVERSION" {
+			return nil, fmt.Errorf("invalid option: %s", option)
+		}
+		withVersion = true
+	}
+	value, ok, err := t.getString(key)
+	if err != nil {
+		return nil, err
+	}
+	if withVersion {
+		if !ok {
+			return []any{nil, 0}, nil
+		}
+		version, err := t.version(key)
+		if err != nil {
+			return nil, err
+		}
+		return []any{value, version}, nil
+	}
+	if !ok {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// cmdCAS implements CAS key version value, which only sets the string value of
+// key if its current version matches (0 meaning the key must not exist). The
+// expiry of the key is kept. It returns the new version or a CONFLICT error
+// with the current version and value.
+func cmdCAS(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	value, err := argString(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	current, ok, err := t.getString(key)
+	if err != nil {
+		return nil, err
+	}
+	version, err := t.version(key)
+	if err != nil {
+		return nil, err
+	}
+	if version != expected {
+		conflict := map[string]any{"version": version, "value": nil}
+		if ok {
+			conflict["value"] = current
+		}
+		return nil, &commandError{code: "CONFLICT", message: "version does not match", data: conflict}
+	}
+	err = t.setString(key, value, true)
+	if err != nil {
+		return nil, err
+	}
+	return t.version(key)
+}
+
+// cmdSet implements SET key value [NX|XX] [EX seconds|PX milliseconds|
+// EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL]. It returns nil
+// if the value was not set because of NX or XX.
+func cmdSet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, -1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	value, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	var nx, xx, keepTTL bool
+	validUntil := int64(-1)
+	for i := 2; i < len(args); i++ {
+		option, err := argString(args, i)
+		if err != nil {
+			return nil, err
+		}
+		switch option = strings.ToUpper(option); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if validUntil != -1 || i+1 >= len(args) {
+				return nil, errors.New("syntax error")
+			}
+			i++
+			validUntil, err = t.parseExpiry(args, i, option)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid option: %s", option)
+		}
+	}
+	if nx && xx {
+		return nil, errors.New("NX and XX are mutually exclusive")
+	}
+	if keepTTL && validUntil != -1 {
+		return nil, errors.New("KEEPTTL and expiry options are mutually exclusive")
+	}
+	if nx || xx {
+		ok, err := t.exists(key)
+		if err != nil {
+			return nil, err
+		}
+		if (nx && ok) || (xx && !ok) {
+			return nil, nil
+		}
+	}
+	err = t.setString(key, value, keepTTL)
+	if err != nil {
+		return nil, err
+	}
+	if validUntil != -1 {
+		_, err = t.setExpiry(key, validUntil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return "OK", nil
+}
+
+// cmdMGet returns the values of all given keys, nil for keys that do not exist
+// or hold another type.
+func cmdMGet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	keys, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		value, ok, err := t.getString(key)
+		if errors.Is(err, errWrongType) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values[i] = value
+		}
+	}
+	return values, nil
+}
+
+func cmdMSet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, -1); err != nil {
+		return nil, err
+	}
+	if len(args)%2 != 0 {
+		return nil, errWrongNumberOfArguments
+	}
+	pairs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		err = t.setString(pairs[i], pairs[i+1], false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return "OK", nil
+}
+
+// maxStringSize is the maximum size of a string value SETRANGE may create.
+const maxStringSize = 512 << 20
+
+// updateString sets the value of key to the result of the SQL expression expr
+// (which may refer to the current value as value) and returns the new length
+// in bytes. Missing keys are created with an empty value first, the expiry of
+// existing keys is kept.
+func (t *txn) updateString(key, expr string, args ...any) (int64, error) {
+	ok, err := t.checkType(key, typeString)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		err = t.checkLock(key)
+		if err == nil {
+			err = t.checkNoSchema(key)
+		}
+	} else {
+		err = t.setString(key, "", false)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var length int64
+	err = t.queryRow("UPDATE data SET value = "+expr+" WHERE key = ? RETURNING length(CAST(value AS BLOB));",
+		append(args, key)...).Scan(&length)
+	if err != nil {
+		return 0, fmt.Errorf("could not update key: %w", err)
+	}
+	_, err = t.bumpVersion(key)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		err = t.notify("set", key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return length, nil
+}
+
+// incrBy adds delta to the integer stored in key, missing keys count as 0.
+func (t *txn) incrBy(key string, delta int64) (int64, error) {
+	value, ok, err := t.getString(key)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if ok {
+		n, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, errors.New("value is not an integer or out of range")
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, errors.New("increment or decrement would overflow")
+	}
+	n += delta
+	err = t.setString(key, strconv.FormatInt(n, 10), true)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// incrCommand returns the implementation of INCR and DECR, which add sign to
+// a key, and of INCRBY and DECRBY, which add sign times their argument if
+// withArg is set.
+func incrCommand(sign int64, withArg bool) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		n := 1
+		if withArg {
+			n = 2
+		}
+		if err := checkArgs(args, n, n); err != nil {
+			return nil, err
+		}
+		key, err := argString(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		delta := int64(1)
+		if withArg {
+			delta, err = argInt(args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if sign < 0 && delta == math.MinInt64 {
+				return nil, errors.New("decrement is out of range")
+			}
+		}
+		return t.incrBy(key, sign*delta)
+	}
+}
+
+// cmdIncrByFloat implements INCRBYFLOAT key increment and returns the new
+// value as a string.
+func cmdIncrByFloat(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	s, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, errors.New("invalid argument 2: expected float")
+	}
+	value, ok, err := t.getString(key)
+	if err != nil {
+		return nil, err
+	}
+	var f float64
+	if ok {
+		f, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, errors.New("value is not a valid float")
+		}
+	}
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New("increment would produce NaN or Infinity")
+	}
+	result := strconv.FormatFloat(f, 'f', -1, 64)
+	err = t.setString(key, result, true)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// cmdAppend implements APPEND key value and returns the new length of the
+// value in bytes.
+func cmdAppend(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	value, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return t.updateString(key, "value || ?", value)
+}
+
+// cmdStrLen returns the length of the value of a key in bytes, 0 if it does
+// not exist.
+func cmdStrLen(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := t.checkType(key, typeString)
+	if err != nil || !ok {
+		return 0, err
+	}
+	var length int64
+	err = t.queryRow("SELECT length(CAST(value AS BLOB)) FROM data WHERE key = ?;", key).Scan(&length)
+	if err != nil {
+		return nil, fmt.Errorf("could not get length of key: %w", err)
+	}
+	return length, nil
+}
+
+// cmdGetRange implements GETRANGE key start end, which returns the bytes
+// between start and end (both inclusive, negative offsets count from the end).
+func cmdGetRange(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	start, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	end, err := argInt(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := t.checkType(key, typeString)
+	if err != nil || !ok {
+		return "", err
+	}
+	var value string
+	err = t.queryRow("SELECT coalesce(CAST(getrange(value, ?, ?) AS TEXT), '') FROM data WHERE key = ?;", start, end, key).Scan(&value)
+	if err != nil {
+		return nil, fmt.Errorf("could not get range of key: %w", err)
+	}
+	return value, nil
+}
+
+// cmdSetRange implements SETRANGE key offset value, which overwrites the
+// value starting at the byte offset (padding it with zero bytes if needed), and
+// returns the new length of the value in bytes.
+func cmdSetRange(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	value, err := argString(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, errors.New("offset is out of range")
+	}
+	if offset+int64(len(value)) > maxStringSize {
+		return nil, errors.New("string exceeds maximum allowed size")
+	}
+	if value == "" {
+		return cmdStrLen(t, args[:1])
+	}
+	return t.updateString(key, "CAST(setrange(value, ?, ?) AS TEXT)", offset, value)
+}
+
+// cmdGetSet implements GETSET key value, which sets a new value (removing the
+// expiry of the key) and returns the old one.
+func cmdGetSet(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	value, err := argString(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	old, ok, err := t.getString(key)
+	if err != nil {
+		return nil, err
+	}
+	err = t.setString(key, value, false)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return old, nil
+}
+
+// cmdGetDel implements GETDEL key, which deletes a string key and returns its
+// value.
+func cmdGetDel(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	value, ok, err := t.getString(key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	_, err = t.del(key)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Transactions queue data commands between MULTI and EXEC and run them in a
+// single database transaction, so they either all take effect or none does.
+// WATCH records the versions of keys; EXEC fails if any of them changed before
+// it ran.
+
+// queuedCommand is a data command queued by a session in MULTI.
+type queuedCommand struct {
+	name string
+	fn   dataCommandFunc
+	args []any
+}
+
+// multiCommands are the commands that are executed immediately in MULTI.
+var multiCommands = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+	"unwatch": true,
+	"end":     true,
+}
+
+var errExecAbort = &commandError{code: "EXECABORT", message: "transaction discarded because of previous errors"}
+
+// queue queues a command in MULTI and returns the reply for it. Commands that
+// can not be queued fail the whole transaction.
+func (s *session) queue(name string, args []any) (any, error) {
+	fn, ok := dataCommands[name]
+	if !ok {
+		s.multiFailed = true
+		if _, ok = commands[name]; ok {
+			return nil, fmt.Errorf("command not allowed in MULTI: %s", name)
+		}
+		return nil, fmt.Errorf("invalid command: %s", name)
+	}
+	s.multi = append(s.multi, queuedCommand{name: name, fn: fn, args: args})
+	return "QUEUED", nil
+}
+
+// resetMulti leaves MULTI and forgets all watched keys.
+func (s *session) resetMulti() {
+	s.inMulti = false
+	s.multiFailed = false
+	s.multi = nil
+	s.watched = nil
+}
+
+func cmdMulti(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	if s.inMulti {
+		return nil, errors.New("MULTI calls can not be nested")
+	}
+	s.inMulti = true
+	return "OK", nil
+}
+
+// cmdExec runs the queued commands and returns their results. It returns nil
+// without running them if a watched key changed and fails with EXECABORT if
+// one of them could not be queued. If a command fails, the transaction is
+// rolled back and an EXECABORT error is returned whose data holds the index of
+// the failed command and its error.
+func cmdExec(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	if !s.inMulti {
+		return nil, errors.New("EXEC without MULTI")
+	}
+	queued, failed, watched := s.multi, s.multiFailed, s.watched
+	s.resetMulti()
+	if failed {
+		return nil, errExecAbort
+	}
+	var results []any
+	changed := false
+	err := s.userDB.update(s.ctx, func(t *txn) error {
+		for key, version := range watched {
+			current, err := t.version(key)
+			if err != nil {
+				return err
+			}
+			if current != version {
+				changed = true
+				return nil
+			}
+		}
+		results = make([]any, len(queued))
+		for i, cmd := range queued {
+			result, err := cmd.fn(t, cmd.args)
+			if err != nil {
+				data := map[string]any{"index": i, "command": cmd.name, "error": err.Error()}
+				var cmdErr *commandError
+				if errors.As(err, &cmdErr) {
+					data["code"] = cmdErr.code
+				}
+				return &commandError{
+					code:    "EXECABORT",
+					message: fmt.Sprintf("transaction rolled back because command %d (%s) failed", i+1, cmd.name),
+					data:    data,
+				}
+			}
+			results[i] = result
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		return nil, nil
+	}
+	return results, nil
+}
+
+func cmdDiscard(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	if !s.inMulti {
+		return nil, errors.New("DISCARD without MULTI")
+	}
+	s.resetMulti()
+	return "OK", nil
+}
+
+// cmdWatch implements WATCH key..., which makes the next EXEC fail if any of
+// the keys is written to (or expires) before it.
+func cmdWatch(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 1, -1); err != nil {
+		return nil, err
+	}
+	if s.inMulti {
+		return nil, errors.New("WATCH inside MULTI is not allowed")
+	}
+	keys, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]int64, len(keys))
+	err = s.userDB.update(s.ctx, func(t *txn) error {
+		for _, key := range keys {
+			version, err := t.version(key)
+			if err != nil {
+				return err
+			}
+			versions[key] = version
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.watched == nil {
+		s.watched = make(map[string]int64)
+	}
+	for key, version := range versions {
+		// Keys that are watched again keep their first version.
+		if _, ok := s.watched[key]; !ok {
+			s.watched[key] = version
+		}
+	}
+	return "OK", nil
+}
+
+func cmdUnwatch(s *session, args []any) (any, error) {
+	if err := checkArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	s.watched = nil
+	return "OK", nil
+}
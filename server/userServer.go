@@ -2,115 +2,119 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type UserServer struct {
-	ctx    context.Context
-	userDB *UserDB
-	logger *slog.Logger
+	ctx     context.Context
+	userDB  *UserDB
+	logger  *slog.Logger
+	options UserServerOptions
+}
+
+// UserServerOptions configures the sessions of a UserServer.
+type UserServerOptions struct {
+	// Protocol is the protocol spoken by sessions.
+	Protocol Protocol
+	// SubscriptionBuffer is the default number of messages queued for a
+	// subscription before its SlowConsumerPolicy kicks in.
+	SubscriptionBuffer int
+	// SlowConsumerPolicy is the default policy for subscriptions whose queue
+	// is full.
+	SlowConsumerPolicy SlowConsumerPolicy
 }
 
-func NewUserServer(logger *slog.Logger, context context.Context, dbPath string) (*UserServer, error) {
+func NewUserServer(logger *slog.Logger, context context.Context, dbPath string, options UserServerOptions) (*UserServer, error) {
 	userDB, err := NewUserDB(context, dbPath, logger)
 	if err != nil {
 		logger.Error("Could not open database", "error", err)
 		return nil, fmt.Errorf("could not open database: %w", err)
 	}
-	return &UserServer{userDB: userDB, logger: logger, ctx: context}, nil
+	return &UserServer{userDB: userDB, logger: logger, ctx: context, options: options}, nil
+}
+
+// session holds the state of a single client talking to a UserServer.
+type session struct {
+	*UserServer
+	// ctx is done once the session ends.
+	ctx    context.Context
+	codec  codec
+	out    *bufio.Writer
+	outMux sync.Mutex
+	// subs maps channel names to the subscriptions of the session.
+	subs map[string]*subscription
+	// psubs maps pattern lists to the pattern subscriptions of the session.
+	psubs   map[string]*subscription
+	subsMux sync.Mutex
+	// seq counts the requests of the session, requests that do not carry an
+	// id get "#<seq>" as id. Being a string, it can not be confused with
+	// numeric ids chosen by the client.
+	seq int64
+	// requestID is the id of the request that is currently executed.
+	requestID any
+	// inMulti is set between MULTI and EXEC or DISCARD, multi holds the
+	// commands queued in the meantime.
+	inMulti bool
+	multi   []queuedCommand
+	// multiFailed is set if a command could not be queued, EXEC then fails.
+	multiFailed bool
+	// watched maps the keys watched by the session to their versions at the
+	// time they were watched.
+	watched map[string]int64
 }
 
+// errEndSession is returned by a command to end the session.
+var errEndSession = errors.New("end of session")
+
 func (s *UserServer) Start(in io.Reader, out io.Writer) error {
 	scanner := bufio.NewScanner(in)
-	write := bufio.NewWriter(out)
-	for scanner.Scan() {
-		var commandList []interface{}
-		err := json.Unmarshal(scanner.Bytes(), &commandList)
-		if err != nil {
-			s.printErrorWithMessage(write, "Could not unmarshal command", err)
-			continue
+	ctx, cancel := context.WithCancel(s.ctx)
+	sess := &session{
+		UserServer: s,
+		ctx:        ctx,
+		out:        bufio.NewWriter(out),
+		subs:       make(map[string]*subscription),
+		psubs:      make(map[string]*subscription),
+	}
+	defer func() {
+		cancel()
+		sess.subsMux.Lock()
+		defer sess.subsMux.Unlock()
+		for _, sub := range sess.subs {
+			<-sub.done
 		}
-		if len(commandList) == 0 {
-			s.printErrorMessage(write, "empty command")
-			continue
+		for _, sub := range sess.psubs {
+			<-sub.done
 		}
-		command, ok := commandList[0].(string)
-		if !ok {
-			s.printErrorMessage(write, "Invalid type of command")
+	}()
+	if s.options.Protocol != ProtocolAuto {
+		sess.codec = newCodec(s.options.Protocol)
+	}
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
 			continue
 		}
-		switch command {
-		case "sql":
-			if len(commandList) < 2 {
-				s.printErrorMessage(write, "Invalid number of arguments")
-				continue
-			}
-			query, ok := commandList[1].(string)
-			if !ok {
-				s.printErrorMessage(write, "Invalid type of argument")
-				continue
-			}
-			args := make([]interface{}, len(commandList)-2)
-			for i := 2; i < len(commandList); i++ {
-				args = append(args, commandList[i])
-			}
-			resp, err := s.userDB.queryToJSON(query, args...)
-			if err != nil {
-				s.printError(write, err)
-				continue
-			}
-			fmt.Println(resp)
-		case "pub":
-			if len(commandList) != 3 {
-				s.printErrorMessage(write, "Invalid number of arguments")
-				continue
-			}
-			channel, ok := commandList[1].(string)
-			if !ok {
-				s.printErrorMessage(write, "Invalid type of argument")
-				continue
-			}
-			message, ok := commandList[2].(string)
-			if !ok {
-				s.printErrorMessage(write, "Invalid type of argument")
-				continue
-			}
-			ch := s.userDB.GetChannel(channel)
-			ch <- message
-		case "sub":
-			if len(commandList) != 2 {
-				s.printErrorWithMessage(write, "Invalid number of arguments", fmt.Errorf("command: %v", command))
-				continue
-			}
-			channel, ok := commandList[1].(string)
-			if !ok {
-				s.printErrorMessage(write, "Invalid type of argument")
-				continue
-			}
-			ch := s.userDB.GetChannel(channel)
-			for {
-				select {
-				case <-s.ctx.Done():
-					return nil
-				case message := <-ch:
-					messageJSON, err := json.Marshal(message)
-					if err != nil {
-						s.logger.Error("Could not marshal message", "error", err)
-						continue
-					}
-					fmt.Println(string(messageJSON))
-					continue
-				}
-			}
-		case "end":
+		if sess.codec == nil {
+			protocol := detectProtocol(line)
+			s.logger.Debug("Detected protocol", "protocol", protocol)
+			sess.codec = newCodec(protocol)
+		}
+		err := sess.handle(line)
+		if errors.Is(err, errEndSession) {
 			return nil
-		default:
-			s.printErrorMessage(write, "Invalid command")
-			continue
+		}
+		if err != nil {
+			s.logger.Error("Could not write reply", "error", err)
+			return fmt.Errorf("could not write reply: %w", err)
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -120,28 +124,91 @@ func (s *UserServer) Start(in io.Reader, out io.Writer) error {
 	return nil
 }
 
-func (s *UserServer) Close() error {
-	return s.userDB.Close()
-}
-
-func (s *UserServer) printErrorMessage(out io.Writer, message string) {
-	s.printError(out, fmt.Errorf(message))
+// handle executes a single request line and writes the reply. Only errors
+// that should end the session are returned.
+func (s *session) handle(line []byte) error {
+	s.seq++
+	req, err := s.codec.decode(line)
+	s.requestID = req.id
+	if s.requestID == nil {
+		s.requestID = "#" + strconv.FormatInt(s.seq, 10)
+	}
+	if err != nil {
+		return s.writeError(err)
+	}
+	commandList := req.args
+	if len(commandList) == 0 {
+		return s.writeError(errors.New("empty command"))
+	}
+	name, ok := commandList[0].(string)
+	if !ok {
+		return s.writeError(errors.New("invalid type of command"))
+	}
+	name = strings.ToLower(name)
+	if s.inMulti && !multiCommands[name] {
+		result, err := s.queue(name, commandList[1:])
+		if err != nil {
+			return s.writeError(err)
+		}
+		return s.writeResult(result)
+	}
+	command, ok := commands[name]
+	if !ok {
+		dataCommand, ok := dataCommands[name]
+		if !ok {
+			return s.writeError(fmt.Errorf("invalid command: %s", name))
+		}
+		command = func(s *session, args []any) (result any, err error) {
+			err = s.userDB.update(s.ctx, func(t *txn) error {
+				result, err = dataCommand(t, args)
+				return err
+			})
+			return result, err
+		}
+	}
+	result, err := command(s, commandList[1:])
+	if errors.Is(err, errEndSession) {
+		return err
+	}
+	if err != nil {
+		return s.writeError(err)
+	}
+	return s.writeResult(result)
 }
 
-func (s *UserServer) printErrorWithMessage(out io.Writer, message string, err error) {
-	message = fmt.Sprintf("%s: %s", message, err)
-	s.printError(out, fmt.Errorf(message))
+func (s *session) writeResult(result any) error {
+	s.outMux.Lock()
+	defer s.outMux.Unlock()
+	err := s.codec.writeResult(s.out, s.requestID, result)
+	if err != nil {
+		return err
+	}
+	return s.out.Flush()
 }
 
-func (s *UserServer) printError(out io.Writer, err error) {
-	message := []string{"error", err.Error()}
-	messageJSON, err := json.Marshal(message)
+func (s *session) writeError(err error) error {
+	s.logger.Debug("Command failed", "id", s.requestID, "error", err)
+	s.outMux.Lock()
+	defer s.outMux.Unlock()
+	err = s.codec.writeError(s.out, s.requestID, err)
 	if err != nil {
-		s.logger.Error("Could not marshal message", "error", err)
-		return
+		return err
 	}
-	_, err = out.Write(messageJSON)
+	return s.out.Flush()
+}
+
+// writePush writes a push message on behalf of the request with the given id.
+// It is safe to call concurrently with the command loop.
+func (s *session) writePush(id any, kind string, payload any) error {
+	s.outMux.Lock()
+	defer s.outMux.Unlock()
+	err := s.codec.writePush(s.out, id, kind, payload)
 	if err != nil {
-		s.logger.Error("Could not write message", "error", err)
+		return err
 	}
+	return s.out.Flush()
+}
+
+func (s *UserServer) Close() error {
+	return s.userDB.Close()
 }
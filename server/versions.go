@@ -0,0 +1,54 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Every write to a key assigns it a new version drawn from a database-wide
+// counter, so a key that is deleted and recreated never reuses a version.
+// Clients use versions for optimistic concurrency control with CAS.
+
+// bumpVersion assigns a new version to key, which must exist, and returns it.
+func (t *txn) bumpVersion(key string) (int64, error) {
+	version, err := t.nextCounter("version")
+	if err != nil {
+		return 0, err
+	}
+	_, err = t.exec("UPDATE data SET version = ? WHERE key = ?;", version, key)
+	if err != nil {
+		return 0, fmt.Errorf("could not set version: %w", err)
+	}
+	t.changed = true
+	return version, nil
+}
+
+// version returns the version of key or 0 if it does not exist.
+func (t *txn) version(key string) (int64, error) {
+	err := t.expire(key)
+	if err != nil {
+		return 0, err
+	}
+	var version int64
+	err = t.queryRow("SELECT version FROM data WHERE key = ?;", key).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not get version: %w", err)
+	}
+	return version, nil
+}
+
+// cmdVersion returns the version of a key of any type, 0 if it does not exist.
+func cmdVersion(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return t.version(key)
+}
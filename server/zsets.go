@@ -0,0 +1,555 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The members of a sorted set are stored in the zsets table with their score.
+// Members are ordered by score and members with the same score by their name,
+// an index on (key, score, member) serves ranges by score and rank.
+
+// parseScore parses a score, which may be -inf or +inf but not NaN.
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errors.New("score is not a valid float")
+	}
+	return f, nil
+}
+
+// formatScore formats a score as returned to clients.
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	default:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+}
+
+// scoreBound is the minimum or maximum of a range of scores.
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+// parseScoreBound parses a bound of ZRANGEBYSCORE and ZCOUNT, a leading "("
+// makes it exclusive.
+func parseScoreBound(s string) (scoreBound, error) {
+	var bound scoreBound
+	if strings.HasPrefix(s, "(") {
+		bound.exclusive = true
+		s = s[1:]
+	}
+	var err error
+	bound.value, err = parseScore(s)
+	if err != nil {
+		return bound, fmt.Errorf("min or max is not a float: %s", s)
+	}
+	return bound, nil
+}
+
+// scoreCondition returns the SQL condition for scores between lower and upper.
+func scoreCondition(lower, upper scoreBound) (string, []any) {
+	lowerOp, upperOp := ">=", "<="
+	if lower.exclusive {
+		lowerOp = ">"
+	}
+	if upper.exclusive {
+		upperOp = "<"
+	}
+	return "score " + lowerOp + " ? AND score " + upperOp + " ?", []any{lower.value, upper.value}
+}
+
+// scoredMember is a member of a sorted set with its score.
+type scoredMember struct {
+	member string
+	score  float64
+}
+
+// zsetMembers collects the rows of a query returning members and scores.
+func (t *txn) zsetMembers(query string, args ...any) ([]scoredMember, error) {
+	rows, err := t.query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not get members: %w", err)
+	}
+	defer rows.Close()
+	var members []scoredMember
+	for rows.Next() {
+		var m scoredMember
+		err = rows.Scan(&m.member, &m.score)
+		if err != nil {
+			return nil, fmt.Errorf("could not get members: %w", err)
+		}
+		members = append(members, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not get members: %w", err)
+	}
+	return members, nil
+}
+
+// scoredResult converts members to a command result, followed by their score
+// if withScores is set.
+func scoredResult(members []scoredMember, withScores bool) []any {
+	result := make([]any, 0, len(members))
+	for _, m := range members {
+		result = append(result, m.member)
+		if withScores {
+			result = append(result, formatScore(m.score))
+		}
+	}
+	return result
+}
+
+// getScore returns the score of a member and whether it exists.
+func (t *txn) getScore(key, member string) (float64, bool, error) {
+	ok, err := t.checkType(key, typeZSet)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	var score float64
+	err = t.queryRow("SELECT score FROM zsets WHERE key = ? AND member = ?;", key, member).Scan(&score)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("could not get score: %w", err)
+	}
+	return score, true, nil
+}
+
+// setScore sets the score of a member, creating the key if necessary, without
+// recording the modification of key.
+func (t *txn) setScore(key, member string, score float64) error {
+	err := t.createKey(key, typeZSet)
+	if err != nil {
+		return err
+	}
+	_, err = t.exec(`INSERT INTO zsets(key, member, score) VALUES (?, ?, ?)
+		ON CONFLICT(key, member) DO UPDATE SET score = excluded.score;`, key, member, score)
+	if err != nil {
+		return fmt.Errorf("could not set score: %w", err)
+	}
+	return nil
+}
+
+// cmdZAdd implements ZADD key [NX|XX] [CH] score member [score member]... NX
+// only adds new members, XX only updates existing ones. It returns the number
+// of members that were added, with CH the number of members that were added
+// or whose score changed.
+func cmdZAdd(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, -1); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	key := strs[0]
+	var nx, xx, ch bool
+	i := 1
+options:
+	for ; i < len(strs); i++ {
+		switch strings.ToUpper(strs[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break options
+		}
+	}
+	if nx && xx {
+		return nil, errors.New("NX and XX are mutually exclusive")
+	}
+	pairs := strs[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, errWrongNumberOfArguments
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		scores[j], err = parseScore(pairs[2*j])
+		if err != nil {
+			return nil, err
+		}
+	}
+	var added, changed int64
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		old, ok, err := t.getScore(key, member)
+		if err != nil {
+			return nil, err
+		}
+		if (ok && nx) || (!ok && xx) || (ok && old == score) {
+			continue
+		}
+		err = t.setScore(key, member, score)
+		if err != nil {
+			return nil, err
+		}
+		changed++
+		if !ok {
+			added++
+		}
+	}
+	if changed > 0 {
+		err = t.modified(key, "zadd")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ch {
+		return changed, nil
+	}
+	return added, nil
+}
+
+// cmdZIncrBy implements ZINCRBY key increment member, missing members count
+// as 0. It returns the new score.
+func cmdZIncrBy(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := parseScore(strs[1])
+	if err != nil {
+		return nil, err
+	}
+	score, _, err := t.getScore(strs[0], strs[2])
+	if err != nil {
+		return nil, err
+	}
+	score += delta
+	if math.IsNaN(score) {
+		return nil, errors.New("resulting score is not a number")
+	}
+	err = t.setScore(strs[0], strs[2], score)
+	if err != nil {
+		return nil, err
+	}
+	return formatScore(score), t.modified(strs[0], "zincr")
+}
+
+// cmdZRem implements ZREM key member... and returns the number of members that
+// were removed. The key is deleted with its last member.
+func cmdZRem(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, -1); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	key := strs[0]
+	ok, err := t.checkType(key, typeZSet)
+	if err != nil || !ok {
+		return 0, err
+	}
+	err = t.checkLock(key)
+	if err != nil {
+		return nil, err
+	}
+	var removed int64
+	for _, member := range strs[1:] {
+		res, err := t.exec("DELETE FROM zsets WHERE key = ? AND member = ?;", key, member)
+		if err != nil {
+			return nil, fmt.Errorf("could not remove member: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("could not remove member: %w", err)
+		}
+		removed += n
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	err = t.modified(key, "zrem")
+	if err != nil {
+		return nil, err
+	}
+	return removed, t.deleteIfEmpty(key, "zsets")
+}
+
+// cmdZScore implements ZSCORE key member and returns nil if the member does
+// not exist.
+func cmdZScore(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	score, ok, err := t.getScore(strs[0], strs[1])
+	if err != nil || !ok {
+		return nil, err
+	}
+	return formatScore(score), nil
+}
+
+// cmdZCard implements ZCARD key and returns the number of members.
+func cmdZCard(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return t.zsetLen(key)
+}
+
+// zsetLen returns the number of members of a sorted set, 0 if it does not
+// exist.
+func (t *txn) zsetLen(key string) (int64, error) {
+	ok, err := t.checkType(key, typeZSet)
+	if err != nil || !ok {
+		return 0, err
+	}
+	var n int64
+	err = t.queryRow("SELECT count(*) FROM zsets WHERE key = ?;", key).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("could not count members: %w", err)
+	}
+	return n, nil
+}
+
+// rankCommand returns the implementation of ZRANK and ZREVRANK key member,
+// which return the 0-based rank of a member in ascending or descending order,
+// nil if it does not exist.
+func rankCommand(reverse bool) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		if err := checkArgs(args, 2, 2); err != nil {
+			return nil, err
+		}
+		strs, err := argStrings(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		score, ok, err := t.getScore(strs[0], strs[1])
+		if err != nil || !ok {
+			return nil, err
+		}
+		before := "score < ?1 OR (score = ?1 AND member < ?2)"
+		if reverse {
+			before = "score > ?1 OR (score = ?1 AND member > ?2)"
+		}
+		var rank int64
+		err = t.queryRow("SELECT count(*) FROM zsets WHERE key = ?3 AND ("+before+");",
+			score, strs[1], strs[0]).Scan(&rank)
+		if err != nil {
+			return nil, fmt.Errorf("could not get rank: %w", err)
+		}
+		return rank, nil
+	}
+}
+
+// cmdZRange implements ZRANGE key start stop [REV] [WITHSCORES], which returns
+// the members from rank start to stop (inclusive, negative ranks count from
+// the end) in ascending or, with REV, descending order.
+func cmdZRange(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 5); err != nil {
+		return nil, err
+	}
+	key, err := argString(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	start, err := argInt(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	stop, err := argInt(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	order, withScores := "ASC", false
+	options, err := argStrings(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		switch strings.ToUpper(option) {
+		case "REV":
+			order = "DESC"
+		case "WITHSCORES":
+			withScores = true
+		default:
+			return nil, fmt.Errorf("invalid option: %s", option)
+		}
+	}
+	n, err := t.zsetLen(key)
+	if err != nil {
+		return nil, err
+	}
+	start, stop, ok := listRange(start, stop, n)
+	if !ok {
+		return []any{}, nil
+	}
+	members, err := t.zsetMembers("SELECT member, score FROM zsets WHERE key = ? ORDER BY score "+order+
+		", member "+order+" LIMIT ? OFFSET ?;", key, stop-start+1, start)
+	if err != nil {
+		return nil, err
+	}
+	return scoredResult(members, withScores), nil
+}
+
+// cmdZRangeByScore implements ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT
+// offset count], which returns the members with a score between min and max in
+// ascending order.
+func cmdZRangeByScore(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 7); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	lower, err := parseScoreBound(strs[1])
+	if err != nil {
+		return nil, err
+	}
+	upper, err := parseScoreBound(strs[2])
+	if err != nil {
+		return nil, err
+	}
+	withScores := false
+	offset, count := int64(0), int64(-1)
+	for i := 3; i < len(strs); i++ {
+		switch option := strings.ToUpper(strs[i]); option {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(strs) {
+				return nil, errors.New("syntax error")
+			}
+			offset, err = argInt(args, i+1)
+			if err != nil {
+				return nil, err
+			}
+			count, err = argInt(args, i+2)
+			if err != nil {
+				return nil, err
+			}
+			if offset < 0 {
+				return nil, errors.New("offset must not be negative")
+			}
+			i += 2
+		default:
+			return nil, fmt.Errorf("invalid option: %s", option)
+		}
+	}
+	_, err = t.checkType(strs[0], typeZSet)
+	if err != nil {
+		return nil, err
+	}
+	condition, conditionArgs := scoreCondition(lower, upper)
+	members, err := t.zsetMembers("SELECT member, score FROM zsets WHERE key = ? AND "+condition+
+		" ORDER BY score, member LIMIT ? OFFSET ?;", append([]any{strs[0]}, append(conditionArgs, count, offset)...)...)
+	if err != nil {
+		return nil, err
+	}
+	return scoredResult(members, withScores), nil
+}
+
+// cmdZCount implements ZCOUNT key min max and returns the number of members
+// with a score between min and max.
+func cmdZCount(t *txn, args []any) (any, error) {
+	if err := checkArgs(args, 3, 3); err != nil {
+		return nil, err
+	}
+	strs, err := argStrings(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	lower, err := parseScoreBound(strs[1])
+	if err != nil {
+		return nil, err
+	}
+	upper, err := parseScoreBound(strs[2])
+	if err != nil {
+		return nil, err
+	}
+	ok, err := t.checkType(strs[0], typeZSet)
+	if err != nil || !ok {
+		return 0, err
+	}
+	condition, conditionArgs := scoreCondition(lower, upper)
+	var n int64
+	err = t.queryRow("SELECT count(*) FROM zsets WHERE key = ? AND "+condition+";",
+		append([]any{strs[0]}, conditionArgs...)...).Scan(&n)
+	if err != nil {
+		return nil, fmt.Errorf("could not count members: %w", err)
+	}
+	return n, nil
+}
+
+// zpopCommand returns the implementation of ZPOPMIN and ZPOPMAX key [count],
+// which remove and return up to count (default 1) members with the lowest or
+// highest scores, each followed by its score.
+func zpopCommand(highest bool) dataCommandFunc {
+	return func(t *txn, args []any) (any, error) {
+		if err := checkArgs(args, 1, 2); err != nil {
+			return nil, err
+		}
+		key, err := argString(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		count := int64(1)
+		if len(args) == 2 {
+			count, err = argInt(args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if count < 0 {
+				return nil, errors.New("count must not be negative")
+			}
+		}
+		ok, err := t.checkType(key, typeZSet)
+		if err != nil || !ok {
+			return []any{}, err
+		}
+		err = t.checkLock(key)
+		if err != nil {
+			return nil, err
+		}
+		order, event := "ASC", "zpopmin"
+		if highest {
+			order, event = "DESC", "zpopmax"
+		}
+		members, err := t.zsetMembers("SELECT member, score FROM zsets WHERE key = ? ORDER BY score "+order+
+			", member "+order+" LIMIT ?;", key, count)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) == 0 {
+			return []any{}, nil
+		}
+		for _, m := range members {
+			_, err = t.exec("DELETE FROM zsets WHERE key = ? AND member = ?;", key, m.member)
+			if err != nil {
+				return nil, fmt.Errorf("could not remove member: %w", err)
+			}
+		}
+		err = t.modified(key, event)
+		if err != nil {
+			return nil, err
+		}
+		return scoredResult(members, true), t.deleteIfEmpty(key, "zsets")
+	}
+}
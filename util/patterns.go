@@ -3,7 +3,9 @@ package util
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"regexp"
+	"strings"
 )
 
 // The following code is largely based on https://github.com/kevinburke/ssh_config
@@ -97,3 +99,17 @@ func MatchPatternList(patterns []*Pattern, input string) bool {
 	}
 	return found
 }
+
+// ParsePatternList parses a comma-separated list of patterns as used in
+// OpenSSH configuration files, e.g. "sensors.*,!sensors.debug".
+func ParsePatternList(s string) ([]*Pattern, error) {
+	var patterns []*Pattern
+	for _, part := range strings.Split(s, ",") {
+		p, err := NewPattern(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", part, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}